@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// defaultUser is the acl user of redis which is used by AUTH <password>.
+const defaultUser = "default"
+
+// dial connects to the host, authenticates and selects the db. If the
+// password is rejected, the credential files are read again.
+func (h redisHost) dial() (redis.Conn, error) {
+	if h.creds == nil {
+		return h.dialWith(h.username, h.password)
+	}
+	username, password, generation := h.creds.get()
+	c, err := h.dialWith(username, password)
+	if hasReply(err, "WRONGPASS") {
+		changed, rerr := h.creds.reload()
+		if rerr != nil {
+			fmt.Printf("[out-redis] %v\n", rerr)
+		}
+		if !changed {
+			return nil, err
+		}
+		username, password, generation = h.creds.get()
+		c, err = h.dialWith(username, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authConn{Conn: c, generation: generation}, nil
+}
+
+func (h redisHost) dialWith(username, password string) (redis.Conn, error) {
+	options := []redis.DialOption{
+		redis.DialUseTLS(h.usetls),
+	}
+	if h.usetls {
+		cfg := h.tls.config(h.tlsskipverify)
+		if cfg.ServerName == "" && h.socket != "" {
+			// the server name can not be derived from the path of the socket
+			cfg.ServerName = "localhost"
+		}
+		options = append(options, redis.DialTLSConfig(cfg))
+	}
+	options = append(options, h.pool.dialOptions(h.timeout)...)
+	if !h.hello {
+		// In case redis needs authentication, AUTH is sent before SELECT
+		options = append(options,
+			redis.DialUsername(username),
+			redis.DialPassword(password),
+			redis.DialClientName(h.clientName),
+			redis.DialDatabase(h.db),
+		)
+		return redis.Dial(h.network(), h.address(), options...)
+	}
+
+	c, err := redis.Dial(h.network(), h.address(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.handshake(c, username, password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake authenticates and names the connection with a single HELLO, which
+// requires redis 6. The protocol stays RESP2, because redigo can not read RESP3.
+func (h redisHost) handshake(c redis.Conn, username, password string) error {
+	args := []interface{}{2}
+	if password != "" {
+		if username == "" {
+			username = defaultUser
+		}
+		args = append(args, "AUTH", username, password)
+	}
+	if h.clientName != "" {
+		args = append(args, "SETNAME", h.clientName)
+	}
+	if _, err := c.Do("HELLO", args...); err != nil {
+		return fmt.Errorf("hello failed: %w", err)
+	}
+	if h.db != 0 {
+		if _, err := c.Do("SELECT", h.db); err != nil {
+			return fmt.Errorf("select failed: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// errBackpressure is returned if a key holds more entries than the high
+// watermark, the host itself is healthy.
+var errBackpressure = errors.New("backpressure")
+
+// watermarks limit the number of entries of a key, e.g. if the consumers of
+// a list fall behind.
+type watermarks struct {
+	// high pauses writing to a key if it has more entries.
+	high int64
+	// low resumes writing to a paused key once it has fewer entries.
+	low int64
+}
+
+func (w *watermarks) String() string {
+	return fmt.Sprintf("highwatermark:%d lowwatermark:%d", w.high, w.low)
+}
+
+// getWatermarks parses the watermarks, nil is returned if high is not set.
+// The low watermark defaults to 80% of the high watermark.
+func getWatermarks(high, low string) (*watermarks, error) {
+	if high == "" {
+		if low != "" {
+			return nil, fmt.Errorf("lowwatermark requires highwatermark")
+		}
+		return nil, nil
+	}
+	w := &watermarks{}
+	var err error
+	w.high, err = strconv.ParseInt(high, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("highwatermark must be a integer: %w", err)
+	}
+	if w.high <= 0 {
+		return nil, fmt.Errorf("highwatermark must be greater than 0 but is:%d", w.high)
+	}
+	if low == "" {
+		w.low = w.high * 8 / 10
+		return w, nil
+	}
+	w.low, err = strconv.ParseInt(low, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("lowwatermark must be a integer: %w", err)
+	}
+	if w.low < 0 {
+		return nil, fmt.Errorf("lowwatermark must not be negative:%d", w.low)
+	}
+	if w.low > w.high {
+		return nil, fmt.Errorf("lowwatermark must not be greater than highwatermark but is:%d", w.low)
+	}
+	return w, nil
+}
+
+// backpressure checks the length of the keys before they are written. A key
+// above the high watermark is paused until its length drops below the low
+// watermark. The state is kept per host, every host holds a key of its own.
+type backpressure struct {
+	*watermarks
+	// length is the command which returns the number of entries of a key.
+	length string
+
+	mu     sync.Mutex
+	paused map[hostKey]bool
+}
+
+// hostKey is a key on a host, the host is "" in cluster mode where every key
+// is owned by a single node.
+type hostKey struct {
+	host string
+	key  string
+}
+
+func (k hostKey) String() string {
+	if k.host == "" {
+		return "key " + k.key
+	}
+	return fmt.Sprintf("host %s: key %s", k.host, k.key)
+}
+
+func newBackpressure(w *watermarks, dataType string) *backpressure {
+	if w == nil {
+		return nil
+	}
+	length := "LLEN"
+	if dataType == dataTypeStream {
+		length = "XLEN"
+	}
+	return &backpressure{
+		watermarks: w,
+		length:     length,
+		paused:     make(map[hostKey]bool),
+	}
+}
+
+// commands returns the commands which read the length of the keys of all batches.
+func (b *backpressure) commands(batches []*keyBatch) []*command {
+	cmds := make([]*command, 0, len(batches))
+	for _, batch := range batches {
+		cmds = append(cmds, &command{name: b.length, key: batch.key, args: []interface{}{batch.key}, index: -1})
+	}
+	return cmds
+}
+
+// verify returns a retryable error if one of the keys measured by cmds is
+// paused on host. The length of every key is logged.
+func (b *backpressure) verify(host string, cmds []*command) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, c := range cmds {
+		k := hostKey{host: host, key: c.key}
+		paused := b.paused[k]
+		switch {
+		case !paused && c.length > b.high:
+			b.paused[k] = true
+			fmt.Printf("[out-redis] %s has %d entries, pausing until it has less than %d\n", k, c.length, b.low)
+		case paused && c.length < b.low:
+			delete(b.paused, k)
+			fmt.Printf("[out-redis] %s has %d entries, resuming\n", k, c.length)
+		case paused:
+			fmt.Printf("[out-redis] %s has %d entries, paused until it has less than %d\n", k, c.length, b.low)
+		default:
+			fmt.Printf("[out-redis] %s has %d entries, the high watermark is %d\n", k, c.length, b.high)
+		}
+		if b.paused[k] && err == nil {
+			err = &sendError{record: -1, err: fmt.Errorf("%w: key %s has %d entries, the high watermark is %d and the low watermark %d", errBackpressure, c.key, c.length, b.high, b.low)}
+		}
+	}
+	return err
+}
+
+// checkBackpressure reads the length of the keys of all batches on rd, which
+// is connected to host, and returns an error if one of them is paused.
+func (r *redisClient) checkBackpressure(rd asyncConnection, host string, batches []*keyBatch) error {
+	if r.backpressure == nil {
+		return nil
+	}
+	cmds := r.backpressure.commands(batches)
+	err := pipeline(rd, cmds)
+	if err != nil {
+		return err
+	}
+	return r.backpressure.verify(host, cmds)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetWatermarks(t *testing.T) {
+	w, err := getWatermarks("", "")
+	require.NoError(t, err)
+	assert.Nil(t, w, "no backpressure expected by default")
+
+	w, err = getWatermarks("1000", "")
+	require.NoError(t, err)
+	assert.Equal(t, &watermarks{high: 1000, low: 800}, w)
+
+	w, err = getWatermarks("1000", "0")
+	require.NoError(t, err)
+	assert.Equal(t, &watermarks{high: 1000, low: 0}, w)
+
+	// invalid configurations
+	_, err = getWatermarks("", "10")
+	assert.EqualError(t, err, "lowwatermark requires highwatermark")
+	_, err = getWatermarks("a", "")
+	assert.EqualError(t, err, "highwatermark must be a integer: strconv.ParseInt: parsing \"a\": invalid syntax")
+	_, err = getWatermarks("0", "")
+	assert.EqualError(t, err, "highwatermark must be greater than 0 but is:0")
+	_, err = getWatermarks("10", "-1")
+	assert.EqualError(t, err, "lowwatermark must not be negative:-1")
+	_, err = getWatermarks("10", "20")
+	assert.EqualError(t, err, "lowwatermark must not be greater than highwatermark but is:20")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "channel", "HighWatermark": "10"}.get)
+	assert.EqualError(t, err, "highwatermark can not be used with datatype channel")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"HighWatermark": "10", "LowWatermark": "5"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list highwatermark:10 lowwatermark:5", c.String())
+}
+
+func TestRedisSendBackpressure(t *testing.T) {
+	rc := &redisClient{
+		key:          mustKeyTemplate(t, "logstash"),
+		backpressure: newBackpressure(&watermarks{high: 10, low: 5}, dataTypeList),
+	}
+	values := []*logmessage{{data: []byte("1")}, {data: []byte("2")}}
+
+	conn := &recordingConnection{replies: []interface{}{int64(10)}}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "the high watermark is not exceeded")
+	assert.Equal(t, [][]interface{}{
+		{"LLEN", "logstash"},
+		{"RPUSH", "logstash", []byte("1")},
+		{"RPUSH", "logstash", []byte("2")},
+	}, conn.commands)
+
+	conn = &recordingConnection{replies: []interface{}{int64(11)}}
+	err = rc.sendImpl(conn, "", values)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errBackpressure))
+	assert.False(t, isPermanent(err), "fluent-bit should retry the flush")
+	assert.EqualError(t, err, "backpressure: key logstash has 11 entries, the high watermark is 10 and the low watermark 5")
+	assert.Equal(t, [][]interface{}{{"LLEN", "logstash"}}, conn.commands, "nothing should be written")
+
+	// the key stays paused until it is below the low watermark
+	conn = &recordingConnection{replies: []interface{}{int64(5)}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "backpressure: key logstash has 5 entries, the high watermark is 10 and the low watermark 5")
+
+	conn = &recordingConnection{replies: []interface{}{int64(4)}}
+	err = rc.sendImpl(conn, "", values)
+	require.NoError(t, err)
+	assert.Len(t, conn.commands, 3)
+}
+
+func TestBackpressureVerifyPerHost(t *testing.T) {
+	b := newBackpressure(&watermarks{high: 10, low: 5}, dataTypeList)
+	length := func(n int64) []*command {
+		return []*command{{name: "LLEN", key: "logstash", length: n}}
+	}
+
+	err := b.verify("a:6379", length(11))
+	assert.EqualError(t, err, "backpressure: key logstash has 11 entries, the high watermark is 10 and the low watermark 5")
+	assert.NoError(t, b.verify("b:6379", length(7)), "the key is only paused on the host which is full")
+	assert.Error(t, b.verify("a:6379", length(7)), "the key stays paused until it is below the low watermark")
+	assert.NoError(t, b.verify("a:6379", length(4)))
+	assert.Equal(t, "host a:6379: key logstash", hostKey{host: "a:6379", key: "logstash"}.String())
+	assert.Equal(t, "key logstash", hostKey{key: "logstash"}.String())
+}
+
+func TestRedisSendBackpressureStream(t *testing.T) {
+	rc := &redisClient{
+		key:          mustKeyTemplate(t, "logs"),
+		dataType:     dataTypeStream,
+		stream:       &streamConfig{fields: streamFieldsMessage},
+		backpressure: newBackpressure(&watermarks{high: 10, low: 5}, dataTypeStream),
+	}
+	conn := &recordingConnection{replies: []interface{}{int64(20)}}
+	err := rc.sendImpl(conn, "", []*logmessage{{data: []byte("1")}})
+	assert.True(t, errors.Is(err, errBackpressure))
+	assert.Equal(t, [][]interface{}{{"XLEN", "logs"}}, conn.commands)
+}
+
+func TestRedisSendBackpressureFailover(t *testing.T) {
+	full := &fakeHost{up: true, length: 100}
+	empty := &fakeHost{up: true}
+	rc := &redisClient{
+		key:          mustKeyTemplate(t, "logstash"),
+		pools:        newTestPools(&healthConfig{failures: 1}, full, empty),
+		backpressure: newBackpressure(&watermarks{high: 10, low: 5}, dataTypeList),
+	}
+	rc.pools.balancer = &roundRobinBalancer{}
+
+	err := rc.send([]*logmessage{{data: []byte("1")}})
+	require.NoError(t, err, "the flush should be written to the other host")
+	assert.Equal(t, 1, full.sends, "only the length should be read")
+	assert.Equal(t, 2, empty.sends)
+	assert.False(t, rc.pools.health[0].isEjected(), "a host with a long list is healthy")
+
+	empty.length = 100
+	err = rc.send([]*logmessage{{data: []byte("1")}})
+	assert.True(t, errors.Is(err, errBackpressure))
+	assert.False(t, isPermanent(err))
+}
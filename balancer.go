@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Possible load balancing strategies to select one of the hosts.
+const (
+	loadBalancingRandom      = "random"
+	loadBalancingRoundRobin  = "round-robin"
+	loadBalancingLeastActive = "least-active"
+	loadBalancingLatencyEWMA = "latency-ewma"
+)
+
+// ewmaWeight is the weight of a new round trip time in the average.
+const ewmaWeight = 0.3
+
+// A balancer orders the hosts a flush is sent to.
+type balancer interface {
+	// order returns the indexes of the candidate pools in the order they are tried.
+	order(candidates []int) []int
+}
+
+func getLoadBalancing(strategy string) (string, error) {
+	if strategy == "" {
+		return loadBalancingRandom, nil
+	}
+	strategy = strings.ToLower(strategy)
+	switch strategy {
+	case loadBalancingRandom, loadBalancingRoundRobin, loadBalancingLeastActive, loadBalancingLatencyEWMA:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("loadbalancing must be one of %s, %s, %s or %s but is:%s", loadBalancingRandom, loadBalancingRoundRobin, loadBalancingLeastActive, loadBalancingLatencyEWMA, strategy)
+}
+
+func newBalancer(strategy string, pools []*redis.Pool) balancer {
+	switch strategy {
+	case loadBalancingRoundRobin:
+		return &roundRobinBalancer{}
+	case loadBalancingLeastActive:
+		return &leastActiveBalancer{pools: pools}
+	case loadBalancingLatencyEWMA:
+		return &ewmaBalancer{hosts: make([]ewma, len(pools))}
+	}
+	return randomBalancer{}
+}
+
+// A randomBalancer tries the hosts in random order.
+type randomBalancer struct{}
+
+func (randomBalancer) order(candidates []int) []int {
+	rand.Shuffle(len(candidates), func(i, j int) { // nolint:gosec
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates
+}
+
+// A roundRobinBalancer starts every flush with the next host.
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) order(candidates []int) []int {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	start := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(candidates)))
+	ordered := make([]int, 0, len(candidates))
+	ordered = append(ordered, candidates[start:]...)
+	return append(ordered, candidates[:start]...)
+}
+
+// A leastActiveBalancer prefers the host with the fewest connections in use.
+type leastActiveBalancer struct {
+	pools []*redis.Pool
+}
+
+func (b *leastActiveBalancer) order(candidates []int) []int {
+	active := make(map[int]int, len(candidates))
+	for _, i := range candidates {
+		active[i] = b.pools[i].ActiveCount()
+	}
+	// hosts with the same count are used equally
+	candidates = randomBalancer{}.order(candidates)
+	sort.SliceStable(candidates, func(x, y int) bool {
+		return active[candidates[x]] < active[candidates[y]]
+	})
+	return candidates
+}
+
+// An ewmaBalancer prefers the host with the lowest exponentially weighted
+// moving average of the round trip time. The round trip times are measured in
+// the background by redisPools.measure, order only reads the averages. Hosts
+// without measurement are tried first.
+type ewmaBalancer struct {
+	mu    sync.Mutex
+	hosts []ewma
+}
+
+type ewma struct {
+	rtt      float64
+	measured bool
+}
+
+func (b *ewmaBalancer) order(candidates []int) []int {
+	costs := make(map[int]float64, len(candidates))
+	b.mu.Lock()
+	for _, i := range candidates {
+		costs[i] = b.hosts[i].rtt
+	}
+	b.mu.Unlock()
+	candidates = randomBalancer{}.order(candidates)
+	sort.SliceStable(candidates, func(x, y int) bool {
+		return costs[candidates[x]] < costs[candidates[y]]
+	})
+	return candidates
+}
+
+// record adds a round trip time of the pool at index i to its average.
+func (b *ewmaBalancer) record(i int, rtt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i >= len(b.hosts) {
+		return
+	}
+	e := &b.hosts[i]
+	if !e.measured {
+		e.rtt, e.measured = float64(rtt), true
+		return
+	}
+	e.rtt += ewmaWeight * (float64(rtt) - e.rtt)
+}
+
+// measure pings all healthy pools concurrently and records their round trip
+// times, if the balancer orders the hosts by them. Ejected pools are pinged
+// by probe.
+func (rp *redisPools) measure() {
+	b, ok := rp.balancer.(*ewmaBalancer)
+	if !ok {
+		return
+	}
+	var wg sync.WaitGroup
+	for i, pool := range rp.pools {
+		if pool == nil || (i < len(rp.health) && rp.health[i].isEjected()) {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pool *redis.Pool) {
+			defer wg.Done()
+			rtt, err := roundTripTime(pool)
+			if err != nil {
+				// a failing host is ejected by its flushes
+				return
+			}
+			b.record(i, rtt)
+		}(i, pool)
+	}
+	wg.Wait()
+}
+
+// roundTripTime returns the time of a PING, without dialing the connection.
+func roundTripTime(pool *redis.Pool) (time.Duration, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	_, err := conn.Do("PING")
+	return time.Since(start), err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetLoadBalancing(t *testing.T) {
+	s, err := getLoadBalancing("")
+	require.NoError(t, err)
+	assert.Equal(t, loadBalancingRandom, s)
+
+	s, err = getLoadBalancing("Latency-EWMA")
+	require.NoError(t, err)
+	assert.Equal(t, loadBalancingLatencyEWMA, s)
+
+	_, err = getLoadBalancing("fastest")
+	assert.EqualError(t, err, "loadbalancing must be one of random, round-robin, least-active or latency-ewma but is:fastest")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"LoadBalancing": "round-robin"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list loadbalancing:round-robin", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"LoadBalancing": "round-robin", "ShardBy": "tag"}.get)
+	assert.EqualError(t, err, "loadbalancing can not be used with shardby")
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	rp := newRankPools(3)
+	rp.balancer = newBalancer(loadBalancingRoundRobin, rp.pools)
+
+	var used []int
+	for i := 0; i < 6; i++ {
+		next, err := rp.next()
+		require.NoError(t, err)
+		used = append(used, next)
+	}
+	assert.Equal(t, []int{0, 1, 2, 0, 1, 2}, used)
+
+	// ejected hosts are skipped
+	rp.health[1].failure(&healthConfig{failures: 1, backoff: time.Hour})
+	assert.Equal(t, []int{0, 2}, rp.candidates())
+	assert.Equal(t, []int{2, 0}, rp.candidates())
+}
+
+func TestLeastActiveBalancer(t *testing.T) {
+	up := &fakeHost{up: true}
+	rp := &redisPools{
+		pools: []*redis.Pool{up.pool("a"), up.pool("b"), up.pool("c")},
+	}
+	rp.balancer = newBalancer(loadBalancingLeastActive, rp.pools)
+
+	// two connections to a and one to c are in use
+	conns := []redis.Conn{rp.pools[0].Get(), rp.pools[0].Get(), rp.pools[2].Get()}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	assert.Equal(t, []int{1, 2, 0}, rp.candidates())
+}
+
+func TestEWMABalancer(t *testing.T) {
+	b := newBalancer(loadBalancingLatencyEWMA, newRankPools(3).pools).(*ewmaBalancer)
+
+	b.record(0, 80*time.Millisecond)
+	b.record(1, 5*time.Millisecond)
+	assert.Equal(t, []int{2, 1, 0}, b.order([]int{0, 1, 2}), "unmeasured hosts should be tried first")
+
+	b.record(2, 20*time.Millisecond)
+	assert.Equal(t, []int{1, 2, 0}, b.order([]int{0, 1, 2}))
+
+	// the average follows slower round trips
+	for i := 0; i < 10; i++ {
+		b.record(1, 100*time.Millisecond)
+	}
+	assert.Equal(t, []int{2, 0, 1}, b.order([]int{0, 1, 2}))
+}
+
+func TestRedisPoolsMeasure(t *testing.T) {
+	up, down, ejected := &fakeHost{up: true}, &fakeHost{}, &fakeHost{up: true}
+	rp := newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, up, down, ejected)
+	rp.balancer = newBalancer(loadBalancingLatencyEWMA, rp.pools)
+	rp.health[2].failure(rp.healthConfig)
+
+	rp.measure()
+	b := rp.balancer.(*ewmaBalancer)
+	assert.True(t, b.hosts[0].measured, "the round trip should be measured with a PING")
+	assert.False(t, b.hosts[1].measured, "a failed PING is not a round trip")
+	assert.False(t, b.hosts[2].measured, "ejected hosts are left to the probe")
+	assert.Equal(t, 0, up.sends, "no flush is sent to measure the round trip")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	defaultBatchSize  = 500
+	defaultBatchBytes = 1 << 20
+)
+
+// A batchConfig bounds the records which are written to a list with a single
+// variadic RPUSH or LPUSH, so a large flush can neither exceed the
+// proto-max-bulk-len nor the client-query-buffer-limit of redis.
+type batchConfig struct {
+	// size is the maximum number of records per command.
+	size int
+	// bytes is the maximum size of the records per command, a larger record
+	// is written with a command of its own.
+	bytes int
+}
+
+func (bc *batchConfig) String() string {
+	return fmt.Sprintf("batchsize:%d batchbytes:%d", bc.size, bc.bytes)
+}
+
+func getBatchConfig(size, bytes string) (*batchConfig, error) {
+	bc := &batchConfig{size: defaultBatchSize, bytes: defaultBatchBytes}
+	var err error
+	if size != "" {
+		bc.size, err = strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("batchsize must be a integer: %w", err)
+		}
+		if bc.size <= 0 {
+			return nil, fmt.Errorf("batchsize must be greater than 0 but is:%d", bc.size)
+		}
+	}
+	if bytes != "" {
+		bc.bytes, err = strconv.Atoi(bytes)
+		if err != nil {
+			return nil, fmt.Errorf("batchbytes must be a integer: %w", err)
+		}
+		if bc.bytes <= 0 {
+			return nil, fmt.Errorf("batchbytes must be greater than 0 but is:%d", bc.bytes)
+		}
+	}
+	return bc, nil
+}
+
+// split returns the end of every sub-batch of values, the order is kept. A
+// nil batchConfig does not split the values.
+func (bc *batchConfig) split(values []*logmessage) []int {
+	if bc == nil {
+		return []int{len(values)}
+	}
+	var (
+		ends  []int
+		count int
+		bytes int
+	)
+	for i, v := range values {
+		if count > 0 && (count == bc.size || bytes+len(v.data) > bc.bytes) {
+			ends = append(ends, i)
+			count, bytes = 0, 0
+		}
+		count++
+		bytes += len(v.data)
+	}
+	if count > 0 {
+		ends = append(ends, len(values))
+	}
+	return ends
+}
+
+// variadic returns true if several records are written to a list with one command.
+func (r *redisClient) variadic() bool {
+	return r.batch != nil && r.dedup == nil && r.script == nil &&
+		(r.dataType == "" || r.dataType == dataTypeList)
+}
+
+// batchCommands returns one command per sub-batch of b, build returns the
+// command which writes the values of a sub-batch.
+func (r *redisClient) batchCommands(b *keyBatch, build func(values []*logmessage) (string, []interface{})) []*command {
+	var (
+		cmds  []*command
+		start int
+	)
+	for _, end := range r.batch.split(b.values) {
+		name, args := build(b.values[start:end])
+		// errors are reported for the first record of the command
+		cmds = append(cmds, &command{name: name, key: b.key, args: args, v: b.values[start], index: b.indexes[start], records: end - start})
+		start = end
+	}
+	return cmds
+}
+
+// pushCommands returns the variadic commands which write the batch to its list.
+func (r *redisClient) pushCommands(b *keyBatch) []*command {
+	return r.batchCommands(b, func(values []*logmessage) (string, []interface{}) {
+		args := make([]interface{}, 0, len(values)+1)
+		args = append(args, b.key)
+		for _, v := range values {
+			args = append(args, v.data)
+		}
+		return r.list.push(), args
+	})
+}
+
+// scriptCommands returns the calls of a batched script, every call gets at
+// most BatchSize records and BatchBytes bytes as ARGV.
+func (r *redisClient) scriptCommands(b *keyBatch) []*command {
+	return r.batchCommands(b, func(values []*logmessage) (string, []interface{}) {
+		return r.script.batchCommand(b.key, values)
+	})
+}
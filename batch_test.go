@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBatchConfig(t *testing.T) {
+	bc, err := getBatchConfig("", "")
+	require.NoError(t, err)
+	assert.Equal(t, &batchConfig{size: 500, bytes: 1 << 20}, bc)
+
+	bc, err = getBatchConfig("100", "65536")
+	require.NoError(t, err)
+	assert.Equal(t, &batchConfig{size: 100, bytes: 65536}, bc)
+
+	// invalid configurations
+	_, err = getBatchConfig("a", "")
+	assert.EqualError(t, err, "batchsize must be a integer: strconv.Atoi: parsing \"a\": invalid syntax")
+	_, err = getBatchConfig("0", "")
+	assert.EqualError(t, err, "batchsize must be greater than 0 but is:0")
+	_, err = getBatchConfig("", "-1")
+	assert.EqualError(t, err, "batchbytes must be greater than 0 but is:-1")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list", c.String(), "the defaults should not be printed")
+	c, err = getRedisConfigFromEnv(mapEnvironment{"BatchSize": "1"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list batchsize:1 batchbytes:1048576", c.String())
+}
+
+func TestBatchSplit(t *testing.T) {
+	values := func(sizes ...int) []*logmessage {
+		var vs []*logmessage
+		for _, size := range sizes {
+			vs = append(vs, &logmessage{data: make([]byte, size)})
+		}
+		return vs
+	}
+	bc := &batchConfig{size: 3, bytes: 10}
+	assert.Nil(t, bc.split(nil))
+	assert.Equal(t, []int{3, 5}, bc.split(values(1, 1, 1, 1, 1)), "split by count")
+	assert.Equal(t, []int{2, 4}, bc.split(values(4, 4, 4, 6)), "split by size")
+	assert.Equal(t, []int{1, 2, 3}, bc.split(values(1, 20, 1)), "a large record is sent on its own")
+}
+
+func TestRedisSendVariadic(t *testing.T) {
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logstash-${tag}"),
+		batch: &batchConfig{size: 2, bytes: 1 << 20},
+	}
+	values := []*logmessage{
+		{data: []byte("1"), tag: "a"},
+		{data: []byte("2"), tag: "b"},
+		{data: []byte("3"), tag: "a"},
+		{data: []byte("4"), tag: "a"},
+	}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "logstash-a", []byte("1"), []byte("3")},
+		{"RPUSH", "logstash-a", []byte("4")},
+		{"RPUSH", "logstash-b", []byte("2")},
+	}, conn.commands)
+
+	// the error names the first record of the command
+	conn = &recordingConnection{replies: []interface{}{int64(2), fmt.Errorf("broken pipe")}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 3: error setting key logstash-a to 4: broken pipe")
+	conn = &recordingConnection{replies: []interface{}{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 0: error setting key logstash-a to 1 and 1 more records: WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestRedisSendVariadicCapped(t *testing.T) {
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logstash"),
+		list:  &listConfig{maxLen: 2, direction: pushDirectionLeft},
+		batch: &batchConfig{size: 500, bytes: 1 << 20},
+	}
+	conn := &recordingConnection{replies: []interface{}{int64(5), "OK"}}
+	err := rc.sendImpl(conn, "", []*logmessage{{data: []byte("1")}, {data: []byte("2")}, {data: []byte("3")}})
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"LPUSH", "logstash", []byte("1"), []byte("2"), []byte("3")},
+		{"LTRIM", "logstash", 0, int64(1)},
+	}, conn.commands)
+	assert.Equal(t, int64(3), rc.list.evicted)
+}
+
+// benchmarkSend writes a flush of 1000 records to a fake redis.
+func benchmarkSend(b *testing.B, batch *batchConfig) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	server := serveFakeRedis(b, l)
+	server.mu.Lock()
+	server.discard = true
+	server.mu.Unlock()
+
+	rc := &redisClient{key: mustKeyTemplate(b, "logstash"), batch: batch}
+	pool := newHostPool(redisHost{hostname: "127.0.0.1", port: l.Addr().(*net.TCPAddr).Port, pool: &defaultPoolConfig})
+	defer pool.Close()
+
+	values := make([]*logmessage, 1000)
+	for i := range values {
+		values[i] = &logmessage{data: []byte(fmt.Sprintf(`{"@timestamp":"2026-10-18T10:00:00.%09dZ","@tag":"app","log":"GET /index.html 200 %d"}`, i, i))}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rc.sendTo(pool, "fake", values); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendPerRecord(b *testing.B) {
+	benchmarkSend(b, nil)
+}
+
+func BenchmarkSendVariadic(b *testing.B) {
+	benchmarkSend(b, &batchConfig{size: defaultBatchSize, bytes: defaultBatchBytes})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Possible reactions if a message was published to a channel without subscribers.
+const (
+	noSubscribersIgnore = "ignore"
+	noSubscribersWarn   = "warn"
+	noSubscribersRetry  = "retry"
+)
+
+var errNoSubscribers = errors.New("no subscribers")
+
+func getNoSubscribers(noSubscribers string) (string, error) {
+	if noSubscribers == "" {
+		return noSubscribersWarn, nil
+	}
+	noSubscribers = strings.ToLower(noSubscribers)
+	switch noSubscribers {
+	case noSubscribersIgnore, noSubscribersWarn, noSubscribersRetry:
+		return noSubscribers, nil
+	}
+	return "", fmt.Errorf("channelnosubscribers must be one of %s, %s or %s but is:%s", noSubscribersIgnore, noSubscribersWarn, noSubscribersRetry, noSubscribers)
+}
+
+// reportPublished prints how many subscribers received the published messages.
+func (r *redisClient) reportPublished(batches []*keyBatch) error {
+	var (
+		published int
+		received  int64
+		unheard   int
+	)
+	for _, b := range batches {
+		for _, v := range b.values {
+			published++
+			receivers := atomic.LoadInt64(&v.receivers)
+			received += receivers
+			if receivers == 0 {
+				unheard++
+			}
+		}
+	}
+	fmt.Printf("published %d logs, %d deliveries to subscribers, %d logs without subscribers\n", published, received, unheard)
+
+	if unheard == 0 {
+		return nil
+	}
+	switch r.noSubscribers {
+	case noSubscribersRetry:
+		return fmt.Errorf("%d of %d logs were not received: %w", unheard, published, errNoSubscribers)
+	case noSubscribersWarn:
+		fmt.Printf("warning: %d of %d logs were published without subscribers\n", unheard, published)
+	}
+	return nil
+}
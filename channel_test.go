@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNoSubscribers(t *testing.T) {
+	n, err := getNoSubscribers("")
+	assert.NoError(t, err)
+	assert.Equal(t, "warn", n, "warn expected by default")
+
+	n, err = getNoSubscribers("Retry")
+	assert.NoError(t, err)
+	assert.Equal(t, "retry", n)
+
+	_, err = getNoSubscribers("panic")
+	assert.EqualError(t, err, "channelnosubscribers must be one of ignore, warn or retry but is:panic")
+}
+
+func TestGetRedisConfigFromEnvChannel(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"DataType": "channel", "Key": "logs:@tag"}.get)
+	assert.NoError(t, err)
+	assert.Equal(t, "channel", c.dataType, "datatype expected to be 'channel'")
+	assert.Equal(t, "warn", c.noSubscribers, "nosubscribers expected to be 'warn' by default")
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logs:@tag datatype:channel nosubscribers:warn", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "channel", "ChannelNoSubscribers": "x"}.get)
+	assert.Error(t, err, "nosubscribers must be validated")
+}
+
+func TestRedisSendChannel(t *testing.T) {
+	rc := &redisClient{
+		key:           mustKeyTemplate(t, "logs:@tag"),
+		dataType:      dataTypeChannel,
+		noSubscribers: noSubscribersWarn,
+	}
+	values := []*logmessage{
+		{data: []byte("test1"), tag: "nginx"},
+		{data: []byte("test2"), tag: "cpu"},
+	}
+	conn := &recordingConnection{replies: []interface{}{int64(2), int64(0)}}
+	err := rc.sendImpl(conn, "", values)
+	assert.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"PUBLISH", "logs:nginx", []byte("test1")},
+		{"PUBLISH", "logs:cpu", []byte("test2")},
+	}, conn.commands)
+	assert.Equal(t, int64(2), values[0].receivers, "first log should be received by two subscribers")
+	assert.Equal(t, int64(0), values[1].receivers, "second log should not be received")
+
+	rc.noSubscribers = noSubscribersRetry
+	conn = &recordingConnection{replies: []interface{}{int64(2), int64(0)}}
+	err = rc.sendImpl(conn, "", values)
+	assert.True(t, errors.Is(err, errNoSubscribers), "a log without subscribers should be retried")
+
+	conn = &recordingConnection{replies: []interface{}{int64(1), int64(1)}}
+	err = rc.sendImpl(conn, "", values)
+	assert.NoError(t, err, "send should be ok if all logs are received")
+
+	conn = &recordingConnection{replies: []interface{}{redis.Error("NOPERM this user has no permissions")}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 0: permission denied by the acl of the redis user: error publishing test1 to channel logs:nginx: NOPERM this user has no permissions")
+	assert.True(t, isPermanent(err), "a missing permission should not be retried")
+}
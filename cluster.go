@@ -0,0 +1,487 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	clusterSlots = 16384
+	// maxRedirects limits the MOVED and ASK redirects followed for one command.
+	maxRedirects = 5
+)
+
+// A redisCluster routes every command to the master which owns the hash slot
+// of its key. The hosts of the configuration are only used as seeds to
+// discover the topology.
+type redisCluster struct {
+	seeds   []string
+	newPool func(addr string) (*redis.Pool, error)
+	// conn returns a connection to the node at addr, replaceable for tests.
+	conn func(addr string) (redis.Conn, error)
+
+	mu sync.RWMutex
+	// slots holds the address of the master serving the slot
+	slots []string
+	// stale is set if the slot map must be loaded before the next send
+	stale bool
+	pools map[string]*redis.Pool
+}
+
+func newClusterFromConfig(rc *redisConfig) *redisCluster {
+	c := &redisCluster{
+		newPool: func(addr string) (*redis.Pool, error) {
+			host, p, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("port must be numeric:%w", err)
+			}
+			return newHostPool(rc.nodeHost(host, port)), nil
+		},
+		stale: true,
+		pools: make(map[string]*redis.Pool),
+	}
+	for _, host := range rc.hosts {
+		c.seeds = append(c.seeds, host.address())
+	}
+	c.conn = c.poolConn
+	return c
+}
+
+// poolConn returns a connection from the pool of the node at addr.
+func (c *redisCluster) poolConn(addr string) (redis.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool, ok := c.pools[addr]
+	if !ok {
+		var err error
+		pool, err = c.newPool(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.pools[addr] = pool
+	}
+	return pool.Get(), nil
+}
+
+func (c *redisCluster) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pool := range c.pools {
+		pool.Close()
+	}
+}
+
+// keySlot returns the hash slot of key, only the hash tag is used if the key contains one.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key))) % clusterSlots
+}
+
+// crc16 implements CRC16-CCITT (XMODEM) which is used by redis cluster.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// refresh loads the slot map from the first node which answers, known
+// masters are asked before the seeds.
+func (c *redisCluster) refresh() error {
+	c.mu.RLock()
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, addr := range append(append([]string{}, c.slots...), c.seeds...) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			candidates = append(candidates, addr)
+		}
+	}
+	c.mu.RUnlock()
+
+	var lastErr error
+	for _, addr := range candidates {
+		slots, err := c.loadSlots(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.stale = false
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unable to load cluster slots: %w", lastErr)
+}
+
+// loadSlots asks the node at addr for the topology with CLUSTER SHARDS,
+// nodes older than redis 7 are asked with CLUSTER SLOTS.
+func (c *redisCluster) loadSlots(addr string) ([]string, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	reply, err := conn.Do("CLUSTER", "SHARDS")
+	if err == nil {
+		return parseClusterShards(reply, addr)
+	}
+	var rerr redis.Error
+	if !errors.As(err, &rerr) || !strings.Contains(strings.ToLower(rerr.Error()), "unknown") {
+		return nil, fmt.Errorf("error loading slots from %s: %w", addr, err)
+	}
+	reply, err = conn.Do("CLUSTER", "SLOTS")
+	if err != nil {
+		return nil, fmt.Errorf("error loading slots from %s: %w", addr, err)
+	}
+	return parseClusterSlots(reply, addr)
+}
+
+// parseClusterSlots parses the reply of CLUSTER SLOTS sent to the node at addr.
+func parseClusterSlots(reply interface{}, addr string) ([]string, error) {
+	ranges, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, clusterSlots)
+	for _, r := range ranges {
+		values, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) < 3 {
+			return nil, fmt.Errorf("slot range has no master: %v", values)
+		}
+		start, err := redis.Int(values[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		end, err := redis.Int(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		master, err := redis.Values(values[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(master) < 2 {
+			return nil, fmt.Errorf("master of slot range %d-%d has no address", start, end)
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := assignSlots(slots, start, end, nodeAddr(host, port, addr)); err != nil {
+			return nil, err
+		}
+	}
+	return slots, nil
+}
+
+// parseClusterShards parses the reply of CLUSTER SHARDS sent to the node at addr.
+func parseClusterShards(reply interface{}, addr string) ([]string, error) {
+	shards, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, clusterSlots)
+	for _, s := range shards {
+		shard, err := flatMap(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges, err := redis.Ints(shard["slots"], nil)
+		if err != nil {
+			return nil, fmt.Errorf("shard has no slots: %w", err)
+		}
+		nodes, err := redis.Values(shard["nodes"], nil)
+		if err != nil {
+			return nil, fmt.Errorf("shard has no nodes: %w", err)
+		}
+		master := ""
+		for _, n := range nodes {
+			node, err := flatMap(n)
+			if err != nil {
+				return nil, err
+			}
+			role, _ := redis.String(node["role"], nil)
+			health, _ := redis.String(node["health"], nil)
+			if role != "master" || (health != "" && health != "online") {
+				continue
+			}
+			host, _ := redis.String(node["endpoint"], nil)
+			if host == "" || host == "?" {
+				host, _ = redis.String(node["ip"], nil)
+			}
+			port, err := redis.Int(node["port"], nil)
+			if err != nil {
+				port, err = redis.Int(node["tls-port"], nil)
+				if err != nil {
+					return nil, fmt.Errorf("master of shard has no port: %w", err)
+				}
+			}
+			master = nodeAddr(host, port, addr)
+		}
+		if master == "" {
+			continue
+		}
+		if len(ranges)%2 != 0 {
+			return nil, fmt.Errorf("shard slots must be pairs of start and end: %v", ranges)
+		}
+		for i := 0; i < len(ranges); i += 2 {
+			if err := assignSlots(slots, ranges[i], ranges[i+1], master); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return slots, nil
+}
+
+// flatMap converts a reply of alternating keys and values to a map.
+func flatMap(reply interface{}) (map[string]interface{}, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("expected pairs of keys and values, got %d elements", len(values))
+	}
+	m := make(map[string]interface{}, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		key, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = values[i+1]
+	}
+	return m, nil
+}
+
+func assignSlots(slots []string, start, end int, addr string) error {
+	if start < 0 || end >= clusterSlots || start > end {
+		return fmt.Errorf("invalid slot range %d-%d", start, end)
+	}
+	for slot := start; slot <= end; slot++ {
+		slots[slot] = addr
+	}
+	return nil
+}
+
+// nodeAddr returns the address of a node, an unknown host means the host of
+// the node at addr.
+func nodeAddr(host string, port int, addr string) string {
+	if host == "" || host == "?" {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// owner returns the address of the master serving slot.
+func (c *redisCluster) owner(slot int) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if slot >= len(c.slots) {
+		return ""
+	}
+	return c.slots[slot]
+}
+
+func (c *redisCluster) setOwner(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot < len(c.slots) {
+		c.slots[slot] = addr
+	}
+	c.stale = true
+}
+
+func (c *redisCluster) markStale() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = true
+}
+
+func (c *redisCluster) isStale() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stale
+}
+
+// A clusterCommand is a command routed to a node of the cluster.
+type clusterCommand struct {
+	*command
+	// asking is set if the command follows an ASK redirect
+	asking bool
+}
+
+// send executes the commands on the masters owning their keys and follows
+// MOVED and ASK redirects.
+func (c *redisCluster) send(cmds []*command) error {
+	if c.isStale() {
+		if err := c.refresh(); err != nil {
+			return err
+		}
+	}
+
+	var (
+		addrs   []string
+		pending = make(map[string][]*clusterCommand)
+	)
+	for _, cmd := range cmds {
+		slot := keySlot(cmd.key)
+		addr := c.owner(slot)
+		if addr == "" {
+			c.markStale()
+			return &sendError{record: cmd.index, err: cmd.error(fmt.Errorf("no cluster node serves slot %d", slot))}
+		}
+		if _, ok := pending[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+		pending[addr] = append(pending[addr], &clusterCommand{command: cmd})
+	}
+
+	for redirects := 0; len(addrs) > 0; redirects++ {
+		if redirects > maxRedirects {
+			return fmt.Errorf("too many cluster redirects")
+		}
+		var (
+			nextAddrs []string
+			next      = make(map[string][]*clusterCommand)
+		)
+		for _, addr := range addrs {
+			redirected, err := c.exec(addr, pending[addr])
+			if err != nil {
+				return err
+			}
+			for target, ccs := range redirected {
+				if _, ok := next[target]; !ok {
+					nextAddrs = append(nextAddrs, target)
+				}
+				next[target] = append(next[target], ccs...)
+			}
+		}
+		addrs, pending = nextAddrs, next
+	}
+	return nil
+}
+
+// exec sends the commands in a pipeline to the node at addr and returns the
+// commands which were redirected, grouped by their target.
+func (c *redisCluster) exec(addr string, ccs []*clusterCommand) (map[string][]*clusterCommand, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, c.nodeError(addr, err)
+	}
+	defer conn.Close()
+
+	for _, cc := range ccs {
+		if cc.asking {
+			if err := conn.Send("ASKING"); err != nil {
+				return nil, c.nodeError(addr, err)
+			}
+		}
+		if err := conn.Send(cc.name, cc.args...); err != nil {
+			return nil, c.nodeError(addr, cc.connError(err))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, c.nodeError(addr, err)
+	}
+
+	redirected := make(map[string][]*clusterCommand)
+	var firstErr *sendError
+	permanent := true
+	for _, cc := range ccs {
+		if cc.asking {
+			if _, err := conn.Receive(); err != nil {
+				return nil, c.nodeError(addr, err)
+			}
+		}
+		reply, err := conn.Receive()
+		if err == nil {
+			cc.reply(reply)
+			continue
+		}
+		var rerr redis.Error
+		if !errors.As(err, &rerr) {
+			// the connection is broken, the remaining replies can not be read
+			return nil, c.nodeError(addr, &sendError{record: cc.index, err: cc.error(err)})
+		}
+		if kind, slot, target, ok := parseRedirect(rerr, addr); ok {
+			if kind == "MOVED" {
+				c.setOwner(slot, target)
+			}
+			redirected[target] = append(redirected[target], &clusterCommand{command: cc.command, asking: kind == "ASK"})
+			continue
+		}
+		se := cc.fail(err)
+		permanent = permanent && se.permanent
+		if firstErr == nil {
+			firstErr = se
+		}
+	}
+	if firstErr != nil {
+		firstErr.permanent = permanent
+		return redirected, c.nodeError(addr, firstErr)
+	}
+	return redirected, nil
+}
+
+// nodeError adds the node to the error and marks the slot map as stale if
+// the error indicates a topology change.
+func (c *redisCluster) nodeError(addr string, err error) error {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) || hasReply(err, "CLUSTERDOWN") || hasReply(err, "TRYAGAIN") {
+		c.markStale()
+	}
+	return withHost(err, addr)
+}
+
+// parseRedirect parses MOVED and ASK errors of the form "MOVED 3999 127.0.0.1:6381".
+func parseRedirect(err redis.Error, addr string) (kind string, slot int, target string, ok bool) {
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, serr := strconv.Atoi(fields[1])
+	if serr != nil {
+		return "", 0, "", false
+	}
+	host, p, serr := net.SplitHostPort(fields[2])
+	if serr != nil {
+		return "", 0, "", false
+	}
+	port, serr := strconv.Atoi(p)
+	if serr != nil {
+		return "", 0, "", false
+	}
+	return fields[0], slot, nodeAddr(host, port, addr), true
+}
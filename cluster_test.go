@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	nodeA = "10.0.0.1:7000"
+	nodeB = "10.0.0.2:7000"
+)
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, 12739, keySlot("123456789"))
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, 5061, keySlot("bar"))
+	assert.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"), "only the hash tag should be hashed")
+	assert.NotEqual(t, keySlot("{}.following"), keySlot(""), "an empty hash tag hashes the whole key")
+}
+
+// A fakeCluster simulates the nodes of a redis cluster.
+type fakeCluster struct {
+	// owner returns the master of a slot
+	owner func(slot int) string
+	// migrating slots reply with ASK to the target
+	migrating map[int]string
+	// noShards simulates a redis older than 7
+	noShards bool
+	down     map[string]bool
+	commands map[string][][]interface{}
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{
+		owner: func(slot int) string {
+			if slot < 8192 {
+				return nodeA
+			}
+			return nodeB
+		},
+		migrating: make(map[int]string),
+		down:      make(map[string]bool),
+		commands:  make(map[string][][]interface{}),
+	}
+}
+
+func (fc *fakeCluster) conn(addr string) (redis.Conn, error) {
+	if fc.down[addr] {
+		return nil, fmt.Errorf("dial tcp %s: connection refused", addr)
+	}
+	return &fakeClusterConn{cluster: fc, addr: addr}, nil
+}
+
+type fakeClusterConn struct {
+	cluster *fakeCluster
+	addr    string
+	asking  bool
+	replies []interface{}
+}
+
+func (c *fakeClusterConn) Close() error { return nil }
+func (c *fakeClusterConn) Err() error   { return nil }
+func (c *fakeClusterConn) Flush() error { return nil }
+
+func (c *fakeClusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd != "CLUSTER" {
+		return nil, fmt.Errorf("unexpected command %s", cmd)
+	}
+	switch args[0] {
+	case "SHARDS":
+		if c.cluster.noShards {
+			return nil, redis.Error("ERR unknown subcommand 'SHARDS'. Try CLUSTER HELP.")
+		}
+		return []interface{}{
+			[]interface{}{
+				[]byte("slots"), []interface{}{int64(0), int64(8191)},
+				[]byte("nodes"), []interface{}{
+					[]interface{}{[]byte("ip"), []byte("10.0.0.1"), []byte("port"), int64(7000), []byte("endpoint"), []byte("10.0.0.1"), []byte("role"), []byte("master"), []byte("health"), []byte("online")},
+					[]interface{}{[]byte("ip"), []byte("10.0.0.3"), []byte("port"), int64(7000), []byte("endpoint"), []byte("10.0.0.3"), []byte("role"), []byte("replica"), []byte("health"), []byte("online")},
+				},
+			},
+			[]interface{}{
+				[]byte("slots"), []interface{}{int64(8192), int64(16383)},
+				[]byte("nodes"), []interface{}{
+					[]interface{}{[]byte("ip"), []byte("10.0.0.2"), []byte("port"), int64(7000), []byte("endpoint"), []byte("10.0.0.2"), []byte("role"), []byte("master"), []byte("health"), []byte("online")},
+				},
+			},
+		}, nil
+	case "SLOTS":
+		return []interface{}{
+			[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(7000), []byte("id-a")}},
+			[]interface{}{int64(8192), int64(16383), []interface{}{[]byte("10.0.0.2"), int64(7000), []byte("id-b")}},
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected subcommand %v", args[0])
+}
+
+func (c *fakeClusterConn) Send(cmd string, args ...interface{}) error {
+	if cmd == "ASKING" {
+		c.asking = true
+		c.replies = append(c.replies, "OK")
+		return nil
+	}
+	c.cluster.commands[c.addr] = append(c.cluster.commands[c.addr], append([]interface{}{cmd}, args...))
+	slot := keySlot(args[0].(string))
+	owner := c.cluster.owner(slot)
+	target, migrating := c.cluster.migrating[slot]
+	switch {
+	case c.asking && migrating && target == c.addr:
+		c.replies = append(c.replies, int64(1))
+	case owner != c.addr:
+		c.replies = append(c.replies, redis.Error(fmt.Sprintf("MOVED %d %s", slot, owner)))
+	case migrating:
+		c.replies = append(c.replies, redis.Error(fmt.Sprintf("ASK %d %s", slot, target)))
+	default:
+		c.replies = append(c.replies, int64(1))
+	}
+	c.asking = false
+	return nil
+}
+
+func (c *fakeClusterConn) Receive() (interface{}, error) {
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func newTestCluster(fc *fakeCluster) *redisCluster {
+	return &redisCluster{
+		seeds: []string{nodeA},
+		conn:  fc.conn,
+		stale: true,
+	}
+}
+
+func TestClusterLoadSlots(t *testing.T) {
+	fc := newFakeCluster()
+	c := newTestCluster(fc)
+	require.NoError(t, c.refresh())
+	assert.Equal(t, nodeA, c.owner(0))
+	assert.Equal(t, nodeA, c.owner(8191))
+	assert.Equal(t, nodeB, c.owner(8192))
+	assert.Equal(t, nodeB, c.owner(16383))
+
+	// redis before 7 does not know CLUSTER SHARDS
+	fc.noShards = true
+	c = newTestCluster(fc)
+	require.NoError(t, c.refresh())
+	assert.Equal(t, nodeA, c.owner(5061))
+	assert.Equal(t, nodeB, c.owner(12182))
+
+	// unreachable seeds
+	fc.down[nodeA] = true
+	c = newTestCluster(fc)
+	err := c.refresh()
+	assert.EqualError(t, err, "unable to load cluster slots: dial tcp 10.0.0.1:7000: connection refused")
+}
+
+func TestParseClusterSlots(t *testing.T) {
+	// an empty host means the host of the asked node
+	slots, err := parseClusterSlots([]interface{}{
+		[]interface{}{int64(0), int64(16383), []interface{}{[]byte(""), int64(7001)}},
+	}, "10.0.0.9:7000")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.9:7001", slots[100])
+
+	_, err = parseClusterSlots([]interface{}{
+		[]interface{}{int64(0), int64(16384), []interface{}{[]byte("10.0.0.1"), int64(7001)}},
+	}, nodeA)
+	assert.EqualError(t, err, "invalid slot range 0-16384")
+
+	_, err = parseClusterSlots([]interface{}{
+		[]interface{}{int64(0), int64(10)},
+	}, nodeA)
+	assert.Error(t, err, "a slot range without master is invalid")
+}
+
+func TestClusterSend(t *testing.T) {
+	fc := newFakeCluster()
+	rc := &redisClient{
+		key:     mustKeyTemplate(t, "${tag}"),
+		cluster: newTestCluster(fc),
+	}
+	values := []*logmessage{
+		{data: []byte("1"), tag: "foo"},
+		{data: []byte("2"), tag: "bar"},
+		{data: []byte("3"), tag: "foo"},
+	}
+	err := rc.send(values)
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "foo", []byte("1")},
+		{"RPUSH", "foo", []byte("3")},
+	}, fc.commands[nodeB], "foo should be sent to the owner of slot 12182")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "bar", []byte("2")},
+	}, fc.commands[nodeA], "bar should be sent to the owner of slot 5061")
+}
+
+func TestClusterSendMoved(t *testing.T) {
+	fc := newFakeCluster()
+	c := newTestCluster(fc)
+	require.NoError(t, c.refresh())
+
+	// slot 12182 of foo failed over to a new node
+	const nodeC = "10.0.0.3:7000"
+	fc.owner = func(slot int) string {
+		switch {
+		case slot == 12182:
+			return nodeC
+		case slot < 8192:
+			return nodeA
+		}
+		return nodeB
+	}
+	rc := &redisClient{key: mustKeyTemplate(t, "${tag}"), cluster: c}
+	err := rc.send([]*logmessage{{data: []byte("1"), tag: "foo"}})
+	require.NoError(t, err)
+	assert.Len(t, fc.commands[nodeB], 1, "the command should be sent to the old owner")
+	assert.Equal(t, [][]interface{}{{"RPUSH", "foo", []byte("1")}}, fc.commands[nodeC], "the command should follow the redirect")
+	assert.Equal(t, nodeC, c.owner(12182), "the slot map should be updated")
+	assert.True(t, c.isStale(), "the slot map should be refreshed on the next send")
+
+	// the next send refreshes the slot map, the topology of the fake still
+	// points to the old owner, so the redirect is followed again
+	err = rc.send([]*logmessage{{data: []byte("2"), tag: "foo"}})
+	require.NoError(t, err)
+	assert.Len(t, fc.commands[nodeB], 2, "the command should be sent to the owner of the refreshed slot map")
+	assert.Len(t, fc.commands[nodeC], 2, "the command should follow the redirect")
+}
+
+func TestClusterSendAsk(t *testing.T) {
+	fc := newFakeCluster()
+	fc.migrating[12182] = nodeA
+	c := newTestCluster(fc)
+	rc := &redisClient{key: mustKeyTemplate(t, "${tag}"), cluster: c}
+	err := rc.send([]*logmessage{{data: []byte("1"), tag: "foo"}})
+	require.NoError(t, err)
+	assert.Len(t, fc.commands[nodeB], 1, "the command should be sent to the owner")
+	assert.Equal(t, [][]interface{}{{"RPUSH", "foo", []byte("1")}}, fc.commands[nodeA], "the command should follow the ask redirect")
+	assert.Equal(t, nodeB, c.owner(12182), "an ask redirect must not change the slot map")
+}
+
+func TestClusterSendNodeDown(t *testing.T) {
+	fc := newFakeCluster()
+	c := newTestCluster(fc)
+	require.NoError(t, c.refresh())
+	fc.down[nodeB] = true
+	rc := &redisClient{key: mustKeyTemplate(t, "${tag}"), cluster: c}
+	err := rc.send([]*logmessage{{data: []byte("1"), tag: "foo"}})
+	assert.EqualError(t, err, "host 10.0.0.2:7000: dial tcp 10.0.0.2:7000: connection refused")
+	assert.True(t, c.isStale(), "the slot map should be refreshed after a node failure")
+}
+
+func TestGetRedisConfigFromEnvCluster(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Cluster": "true", "Hosts": "10.0.0.1:7000 10.0.0.2:7000"}.get)
+	require.NoError(t, err)
+	assert.True(t, c.cluster, "cluster expected to be true")
+	assert.Equal(t, "hosts:[{10.0.0.1 7000} {10.0.0.2 7000}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list cluster:true", c.String())
+	cluster := newClusterFromConfig(c)
+	assert.Equal(t, []string{nodeA, nodeB}, cluster.seeds, "hosts should be used as seeds")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Cluster": "yes"}.get)
+	assert.EqualError(t, err, "cluster must be a bool: strconv.ParseBool: parsing \"yes\": invalid syntax")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Cluster": "true", "DB": "1"}.get)
+	assert.EqualError(t, err, "db must be 0 in cluster mode but is:1")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Cluster": "true", "DataType": "channel"}.get)
+	assert.EqualError(t, err, "datatype channel is not supported in cluster mode")
+}
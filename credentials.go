@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// credentialsCheckInterval is the interval in which the credential files are checked for changes.
+const credentialsCheckInterval = 10 * time.Second
+
+// credentials hold username and password which are read from files, e.g.
+// mounted kubernetes secrets, and reloaded if they change.
+type credentials struct {
+	usernameFile string
+	passwordFile string
+
+	mu       sync.RWMutex
+	username string
+	password string
+	// generation is incremented with every change of the credentials
+	generation uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newCredentials returns nil if no file is configured.
+func newCredentials(username, password, usernameFile, passwordFile string) (*credentials, error) {
+	if usernameFile == "" && passwordFile == "" {
+		return nil, nil
+	}
+	if username != "" && usernameFile != "" {
+		return nil, fmt.Errorf("username and usernamefile can not be used together")
+	}
+	if password != "" && passwordFile != "" {
+		return nil, fmt.Errorf("password and passwordfile can not be used together")
+	}
+	c := &credentials{
+		usernameFile: usernameFile,
+		passwordFile: passwordFile,
+		username:     username,
+		password:     password,
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func readCredential(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimRight(string(b), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return value, nil
+}
+
+// get returns the current credentials and their generation.
+func (c *credentials) get() (string, string, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username, c.password, c.generation
+}
+
+// reload reads the files and returns true if the credentials changed.
+func (c *credentials) reload() (bool, error) {
+	username, password, _ := c.get()
+	var err error
+	if c.usernameFile != "" {
+		username, err = readCredential(c.usernameFile)
+		if err != nil {
+			return false, fmt.Errorf("unable to read usernamefile: %w", err)
+		}
+	}
+	if c.passwordFile != "" {
+		password, err = readCredential(c.passwordFile)
+		if err != nil {
+			return false, fmt.Errorf("unable to read passwordfile: %w", err)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if username == c.username && password == c.password {
+		return false, nil
+	}
+	c.username = username
+	c.password = password
+	c.generation++
+	return true, nil
+}
+
+// start checks the files for changes in the background until close is called.
+func (c *credentials) start() {
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(credentialsCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				changed, err := c.reload()
+				if err != nil {
+					fmt.Printf("[out-redis] %v\n", err)
+					continue
+				}
+				if changed {
+					fmt.Print("[out-redis] credentials changed, connections are authenticated again\n")
+				}
+			}
+		}
+	}()
+}
+
+func (c *credentials) close() {
+	if c.done == nil {
+		return
+	}
+	close(c.done)
+	c.wg.Wait()
+}
+
+// An authConn is a connection which knows the generation of the credentials
+// it is authenticated with.
+type authConn struct {
+	redis.Conn
+	generation uint64
+}
+
+// reauth authenticates a pooled connection again if the credentials changed
+// since it was dialed.
+func (h redisHost) reauth(c redis.Conn) error {
+	ac, ok := c.(*authConn)
+	if !ok || h.creds == nil {
+		return nil
+	}
+	username, password, generation := h.creds.get()
+	if ac.generation == generation {
+		return nil
+	}
+	args := []interface{}{password}
+	if username != "" {
+		args = []interface{}{username, password}
+	}
+	if _, err := ac.Do("AUTH", args...); err != nil {
+		return err
+	}
+	ac.generation = generation
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCredential(t *testing.T, file, value string) {
+	require.NoError(t, os.WriteFile(file, []byte(value), 0600))
+}
+
+func TestNewCredentials(t *testing.T) {
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	writeCredential(t, usernameFile, "logs\n")
+	writeCredential(t, passwordFile, "secret\r\n")
+
+	c, err := newCredentials("", "", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, c, "no credentials should be created without files")
+
+	c, err = newCredentials("", "", usernameFile, passwordFile)
+	require.NoError(t, err)
+	username, password, generation := c.get()
+	assert.Equal(t, "logs", username)
+	assert.Equal(t, "secret", password, "the line break should be removed")
+
+	changed, err := c.reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	writeCredential(t, passwordFile, "rotated")
+	changed, err = c.reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	_, password, g := c.get()
+	assert.Equal(t, "rotated", password)
+	assert.Equal(t, generation+1, g)
+
+	_, err = newCredentials("", "secret", "", passwordFile)
+	assert.EqualError(t, err, "password and passwordfile can not be used together")
+	_, err = newCredentials("logs", "", usernameFile, "")
+	assert.EqualError(t, err, "username and usernamefile can not be used together")
+	_, err = newCredentials("", "", "", filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	writeCredential(t, passwordFile, "\n")
+	_, err = newCredentials("", "", "", passwordFile)
+	assert.EqualError(t, err, "unable to read passwordfile: "+passwordFile+" is empty")
+}
+
+func TestGetRedisConfigFromEnvCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	writeCredential(t, passwordFile, "secret")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Username": "logs", "PasswordFile": passwordFile}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", c.password)
+	assert.Same(t, c.credentials, c.hosts[0].creds)
+	assert.NotContains(t, c.String(), "secret", "the password must not be printed")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"UsernameFile": passwordFile}.get)
+	assert.EqualError(t, err, "username requires a password")
+}
+
+func TestCredentialRotation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := serveFakeRedis(t, l)
+	server.requirePass("old")
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	writeCredential(t, passwordFile, "old")
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Hosts": l.Addr().String(), "Username": "logs", "PasswordFile": passwordFile}.get)
+	require.NoError(t, err)
+	pool := newHostPool(c.hosts[0])
+	defer pool.Close()
+	require.NoError(t, ping(pool))
+
+	// the pooled connection is authenticated again after the rotation
+	server.requirePass("new")
+	writeCredential(t, passwordFile, "new")
+	changed, err := c.credentials.reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.NoError(t, ping(pool))
+	assert.Equal(t, [][]string{
+		{"AUTH", "logs", "old"}, {"PING"},
+		{"AUTH", "logs", "new"}, {"PING"},
+	}, server.received())
+
+	// a rejected password reloads the file before the connection is dialed again
+	server.requirePass("newer")
+	writeCredential(t, passwordFile, "newer")
+	other := newHostPool(c.hosts[0])
+	defer other.Close()
+	require.NoError(t, ping(other), "a connection should be dialed with the reloaded password")
+	assert.Equal(t, [][]string{
+		{"AUTH", "logs", "new"},
+		{"AUTH", "logs", "newer"}, {"PING"},
+	}, server.received()[4:])
+}
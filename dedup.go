@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dedupScript writes a record only if its marker does not exist yet. The
+// marker and the record are written atomically, so a record is never lost
+// because its marker was set by a failed flush. A duplicate is replied with nil.
+//
+// KEYS[1] is the key of the record, KEYS[2] the marker, ARGV[1] the dedup
+// window in seconds, ARGV[2] the command and ARGV[3...] its arguments.
+const dedupScript = `if redis.call('SET', KEYS[2], '1', 'NX', 'EX', ARGV[1]) then
+  return redis.call(ARGV[2], KEYS[1], unpack(ARGV, 3))
+end
+return false`
+
+// A dedup skips records which were already written within the window, e.g.
+// if a flush timed out after it was written and is retried by fluent-bit.
+type dedup struct {
+	window time.Duration
+	// skipped counts the duplicates since the start.
+	skipped int64
+}
+
+// getDedupWindow parses the window either as seconds or as duration like 10m.
+func getDedupWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := getTimeout("dedupwindow", window)
+	if err != nil {
+		return 0, err
+	}
+	if d > 0 && d < time.Second {
+		return 0, fmt.Errorf("dedupwindow must be at least 1s but is:%s", window)
+	}
+	return d, nil
+}
+
+func newDedup(window time.Duration) *dedup {
+	if window <= 0 {
+		return nil
+	}
+	return &dedup{window: window}
+}
+
+// id returns the deterministic id of the message, a retried flush creates
+// the same ids.
+func (m *logmessage) id() string {
+	h := sha256.New()
+	h.Write([]byte(m.tag))
+	h.Write([]byte{0})
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(m.timestamp.UnixNano()))
+	h.Write(ts[:])
+	h.Write(m.data)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// markerKey returns the key of the marker of the record with id which is
+// written to key. It is in the same cluster slot as key.
+func markerKey(key, id string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			// key has a hash tag, which is kept as the first one
+			return key + ":dedup:" + id
+		}
+	}
+	return "{" + key + "}:dedup:" + id
+}
+
+// wrap returns the EVAL command which executes the command name with args
+// only if the message was not written within the window.
+func (d *dedup) wrap(key string, v *logmessage, name string, args []interface{}) (string, []interface{}) {
+	wrapped := []interface{}{dedupScript, 2, key, markerKey(key, v.id()), int64(d.window / time.Second), name}
+	// the first argument is the key
+	return "EVAL", append(wrapped, args[1:]...)
+}
+
+// reportSkipped logs how many records were duplicates.
+func (d *dedup) reportSkipped(cmds []*command) {
+	if d == nil {
+		return
+	}
+	var skipped int64
+	for _, c := range cmds {
+		if atomic.LoadInt32(&c.duplicate) != 0 {
+			skipped++
+		}
+	}
+	if skipped == 0 {
+		return
+	}
+	total := atomic.AddInt64(&d.skipped, skipped)
+	fmt.Printf("[out-redis] skipped %d records which were already written within the dedup window, %d in total\n", skipped, total)
+}
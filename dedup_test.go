@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDedupWindow(t *testing.T) {
+	window, err := getDedupWindow("")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), window, "no dedup expected by default")
+
+	window, err = getDedupWindow("600")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, window)
+
+	window, err = getDedupWindow("1h")
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, window)
+
+	// invalid configurations
+	_, err = getDedupWindow("-1")
+	assert.EqualError(t, err, "dedupwindow must not be negative:-1")
+	_, err = getDedupWindow("100ms")
+	assert.EqualError(t, err, "dedupwindow must be at least 1s but is:100ms")
+	_, err = getDedupWindow("a day")
+	assert.EqualError(t, err, "dedupwindow must be seconds or a duration: time: invalid duration \"a day\"")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "channel", "DedupWindow": "60"}.get)
+	assert.EqualError(t, err, "dedupwindow can not be used with datatype channel")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"DedupWindow": "10m"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list dedupwindow:10m0s", c.String())
+}
+
+func TestLogmessageID(t *testing.T) {
+	ts := time.Date(2026, time.October, 18, 10, 0, 0, 1, time.UTC)
+	m := &logmessage{data: []byte(`{"log":"a"}`), tag: "app", timestamp: ts}
+	assert.Len(t, m.id(), 32)
+	assert.Equal(t, m.id(), (&logmessage{data: []byte(`{"log":"a"}`), tag: "app", timestamp: ts}).id(), "the id must be deterministic")
+
+	assert.NotEqual(t, m.id(), (&logmessage{data: []byte(`{"log":"a"}`), tag: "other", timestamp: ts}).id())
+	assert.NotEqual(t, m.id(), (&logmessage{data: []byte(`{"log":"a"}`), tag: "app", timestamp: ts.Add(1)}).id())
+	assert.NotEqual(t, m.id(), (&logmessage{data: []byte(`{"log":"b"}`), tag: "app", timestamp: ts}).id())
+}
+
+func TestMarkerKey(t *testing.T) {
+	assert.Equal(t, "{logstash}:dedup:abc", markerKey("logstash", "abc"))
+	assert.Equal(t, "logs:{app}:dedup:abc", markerKey("logs:{app}", "abc"))
+	for _, key := range []string{"logstash", "logs:{app}", "logs:{app}:{b}", "logs-2026.10.18"} {
+		assert.Equal(t, keySlot(key), keySlot(markerKey(key, "abc")), "the marker of %s must be in the same slot", key)
+	}
+}
+
+func TestRedisSendDedup(t *testing.T) {
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logstash"),
+		dedup: newDedup(10 * time.Minute),
+	}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"EVAL", dedupScript, 2, "logstash", "{logstash}:dedup:" + values[0].id(), int64(600), "RPUSH", []byte("test1")},
+		{"EVAL", dedupScript, 2, "logstash", "{logstash}:dedup:" + values[1].id(), int64(600), "RPUSH", []byte("test2")},
+	}, conn.commands)
+	assert.Equal(t, int64(0), rc.dedup.skipped)
+
+	// the retried flush is skipped by the script
+	conn = &recordingConnection{replies: []interface{}{nil, int64(3)}}
+	err = rc.sendImpl(conn, "", values)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), rc.dedup.skipped)
+}
+
+func TestRedisSendDedupCapped(t *testing.T) {
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logstash"),
+		list:  &listConfig{maxLen: 2, direction: pushDirectionRight},
+		dedup: newDedup(time.Minute),
+	}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+	conn := &recordingConnection{replies: []interface{}{int64(3), nil, "OK"}}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"LTRIM", "logstash", int64(-2), -1}, conn.commands[2], "the list is trimmed without the script")
+	assert.Equal(t, int64(1), rc.list.evicted, "the length of the last written record counts")
+	assert.Equal(t, int64(1), rc.dedup.skipped)
+}
+
+func TestRedisSendDedupStream(t *testing.T) {
+	rc := &redisClient{
+		key:      mustKeyTemplate(t, "logs"),
+		dataType: dataTypeStream,
+		stream:   &streamConfig{maxLen: 10, fields: streamFieldsMessage},
+		dedup:    newDedup(time.Minute),
+	}
+	v := &logmessage{data: []byte("test1")}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", []*logmessage{v})
+	require.NoError(t, err)
+	assert.Equal(t, [][]interface{}{
+		{"EVAL", dedupScript, 2, "logs", "{logs}:dedup:" + v.id(), int64(60), "XADD", "MAXLEN", "=", int64(10), "*", "message", []byte("test1")},
+	}, conn.commands)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A keyExpiry sets a ttl on every key a flush writes to, e.g. on time
+// bucketed keys, so old buckets disappear on their own. The ttl is set again
+// with every flush: a host which missed a flush, a failover and a key which
+// expired and is written again all end up with an expiry.
+type keyExpiry struct {
+	ttl time.Duration
+}
+
+// getKeyExpire parses the ttl either as seconds or as duration like 168h.
+func getKeyExpire(expire string) (time.Duration, error) {
+	if expire == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(expire)
+	if err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("keyexpire must not be negative:%s", expire)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(expire)
+	if err != nil {
+		return 0, fmt.Errorf("keyexpire must be seconds or a duration: %w", err)
+	}
+	if ttl < time.Second {
+		return 0, fmt.Errorf("keyexpire must be at least 1s but is:%s", expire)
+	}
+	return ttl, nil
+}
+
+func newKeyExpiry(ttl time.Duration) *keyExpiry {
+	if ttl <= 0 {
+		return nil
+	}
+	return &keyExpiry{ttl: ttl}
+}
+
+// expireArgs returns the arguments of EXPIRE for key.
+func (e *keyExpiry) expireArgs(key string) []interface{} {
+	return []interface{}{key, int64(e.ttl / time.Second)}
+}
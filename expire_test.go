@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetKeyExpire(t *testing.T) {
+	ttl, err := getKeyExpire("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl, "no expire expected by default")
+
+	ttl, err = getKeyExpire("3600")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl)
+
+	ttl, err = getKeyExpire("168h")
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, ttl)
+
+	// invalid configurations
+	_, err = getKeyExpire("-1")
+	assert.EqualError(t, err, "keyexpire must not be negative:-1")
+
+	_, err = getKeyExpire("10ms")
+	assert.EqualError(t, err, "keyexpire must be at least 1s but is:10ms")
+
+	_, err = getKeyExpire("a week")
+	assert.EqualError(t, err, "keyexpire must be seconds or a duration: time: invalid duration \"a week\"")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "channel", "KeyExpire": "60"}.get)
+	assert.EqualError(t, err, "keyexpire can not be used with datatype channel")
+}
+
+func TestRedisSendExpire(t *testing.T) {
+	rc := &redisClient{
+		key:    mustKeyTemplate(t, "logstash-%{+YYYY.MM.dd}"),
+		expiry: newKeyExpiry(time.Hour),
+	}
+	day1 := time.Date(2026, time.October, 17, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	values := []*logmessage{
+		{data: []byte("1"), timestamp: day1},
+		{data: []byte("2"), timestamp: day2},
+		{data: []byte("3"), timestamp: day1},
+	}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", values)
+	assert.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "logstash-2026.10.17", []byte("1")},
+		{"RPUSH", "logstash-2026.10.17", []byte("3")},
+		{"EXPIRE", "logstash-2026.10.17", int64(3600)},
+		{"RPUSH", "logstash-2026.10.18", []byte("2")},
+		{"EXPIRE", "logstash-2026.10.18", int64(3600)},
+	}, conn.commands)
+
+	// the expire is set again, the key may have expired or the flush may go to another host
+	conn = &recordingConnection{}
+	err = rc.sendImpl(conn, "", []*logmessage{{data: []byte("4"), timestamp: day2}})
+	assert.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "logstash-2026.10.18", []byte("4")},
+		{"EXPIRE", "logstash-2026.10.18", int64(3600)},
+	}, conn.commands)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// A healthConfig defines when a failing host is ejected from the pools.
+type healthConfig struct {
+	// failures is the number of consecutive failures which eject a host.
+	failures int
+	// backoff is the time a host is ejected the first time, it doubles with
+	// every failed probe up to maxBackoff.
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// interval between the PING probes of ejected hosts
+	interval time.Duration
+}
+
+func getHealthConfig(failures, backoff, maxBackoff, interval string) (*healthConfig, error) {
+	hc := &healthConfig{}
+	// defaults
+	if failures == "" {
+		failures = "3"
+	}
+	if backoff == "" {
+		backoff = "1s"
+	}
+	if maxBackoff == "" {
+		maxBackoff = "1m"
+	}
+	if interval == "" {
+		interval = "1s"
+	}
+
+	f, err := strconv.Atoi(failures)
+	if err != nil {
+		return nil, fmt.Errorf("ejectafterfailures must be a integer: %w", err)
+	}
+	if f < 1 {
+		return nil, fmt.Errorf("ejectafterfailures must be at least 1 but is:%d", f)
+	}
+	hc.failures = f
+
+	hc.backoff, err = time.ParseDuration(backoff)
+	if err != nil {
+		return nil, fmt.Errorf("ejectbackoff must be a duration: %w", err)
+	}
+	hc.maxBackoff, err = time.ParseDuration(maxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("ejectmaxbackoff must be a duration: %w", err)
+	}
+	if hc.backoff <= 0 || hc.maxBackoff < hc.backoff {
+		return nil, fmt.Errorf("ejectbackoff must be positive and not greater than ejectmaxbackoff but is:%s", hc.backoff)
+	}
+	hc.interval, err = time.ParseDuration(interval)
+	if err != nil {
+		return nil, fmt.Errorf("healthcheckinterval must be a duration: %w", err)
+	}
+	if hc.interval <= 0 {
+		return nil, fmt.Errorf("healthcheckinterval must be positive but is:%s", hc.interval)
+	}
+	return hc, nil
+}
+
+// A poolHealth tracks the successes and failures of a pool.
+type poolHealth struct {
+	mu        sync.Mutex
+	successes int64
+	failures  int64
+	// consecutive failures since the last success
+	consecutive int
+	ejected     bool
+	// the next probe is not before retryAt
+	retryAt time.Time
+	backoff time.Duration
+}
+
+func (h *poolHealth) isEjected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ejected
+}
+
+// success marks the pool as healthy.
+func (h *poolHealth) success() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.successes++
+	h.consecutive = 0
+	h.ejected = false
+	h.backoff = 0
+}
+
+// failure counts a failure and returns true if the pool is ejected by it.
+func (h *poolHealth) failure(hc *healthConfig) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.consecutive++
+	if h.ejected || h.consecutive < hc.failures {
+		return false
+	}
+	h.ejected = true
+	h.backoff = hc.backoff
+	h.retryAt = time.Now().Add(h.backoff)
+	return true
+}
+
+// probeDue returns true if the pool is ejected and the backoff expired.
+func (h *poolHealth) probeDue(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ejected && !now.Before(h.retryAt)
+}
+
+// probeFailed doubles the backoff of an ejected pool.
+func (h *poolHealth) probeFailed(hc *healthConfig) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	h.backoff *= 2
+	if h.backoff > hc.maxBackoff {
+		h.backoff = hc.maxBackoff
+	}
+	h.retryAt = time.Now().Add(h.backoff)
+	return h.backoff
+}
+
+// candidates returns the indexes of all healthy pools in the order of the
+// balancer. If all pools are ejected, all are returned, so the flush is tried anyway.
+func (rp *redisPools) candidates() []int {
+	var healthy, ejected []int
+	for i := range rp.pools {
+		if rp.pools[i] == nil {
+			continue
+		}
+		if i < len(rp.health) && rp.health[i].isEjected() {
+			ejected = append(ejected, i)
+			continue
+		}
+		healthy = append(healthy, i)
+	}
+	if len(healthy) == 0 {
+		healthy = ejected
+	}
+	if rp.balancer == nil {
+		return randomBalancer{}.order(healthy)
+	}
+	return rp.balancer.order(healthy)
+}
+
+// success marks the pool at index i as healthy.
+func (rp *redisPools) success(i int) {
+	if i >= len(rp.health) {
+		return
+	}
+	if rp.health[i].isEjected() {
+		fmt.Printf("[out-redis] host %s is healthy again\n", rp.host(i))
+	}
+	rp.health[i].success()
+}
+
+// failure counts a failure of the pool at index i, which may eject it.
+func (rp *redisPools) failure(i int, err error) {
+	if i >= len(rp.health) || rp.healthConfig == nil {
+		return
+	}
+	if rp.health[i].failure(rp.healthConfig) {
+		fmt.Printf("[out-redis] host %s is ejected for %s after %d failures: %v\n", rp.host(i), rp.healthConfig.backoff, rp.healthConfig.failures, err)
+	}
+}
+
+// blamesHost returns false for errors the host is not to blame for, e.g. a
+// paused key or a channel without subscribers, they do not count as failure.
+func blamesHost(err error) bool {
+	return !errors.Is(err, errBackpressure) && !errors.Is(err, errNoSubscribers)
+}
+
+// startProbe pings the ejected pools in the background until closeAll is
+// called. The round trip times of the other pools are measured as well.
+func (rp *redisPools) startProbe() {
+	if rp.healthConfig == nil {
+		return
+	}
+	rp.done = make(chan struct{})
+	rp.wg.Add(1)
+	go func() {
+		defer rp.wg.Done()
+		ticker := time.NewTicker(rp.healthConfig.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rp.done:
+				return
+			case <-ticker.C:
+				rp.probe()
+				rp.measure()
+			}
+		}
+	}()
+}
+
+// probe pings all ejected pools whose backoff expired.
+func (rp *redisPools) probe() {
+	now := time.Now()
+	for i, h := range rp.health {
+		if !h.probeDue(now) {
+			continue
+		}
+		err := ping(rp.pools[i])
+		if err != nil {
+			backoff := h.probeFailed(rp.healthConfig)
+			fmt.Printf("[out-redis] host %s is still ejected for %s: %v\n", rp.host(i), backoff, err)
+			continue
+		}
+		rp.success(i)
+	}
+}
+
+func ping(pool *redis.Pool) error {
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
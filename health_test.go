@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A fakeHost is a redis server which is up or down.
+type fakeHost struct {
+	up    bool
+	sends int
+	// reply is returned for every command if set
+	reply error
+	// wait blocks every reply until it is closed if set
+	wait chan struct{}
+	// length is the reply of LLEN
+	length int64
+	// noSubscribers replies 0 receivers to PUBLISH
+	noSubscribers bool
+}
+
+func (h *fakeHost) pool(addr string) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			if !h.up {
+				return nil, fmt.Errorf("dial tcp %s: connection refused", addr)
+			}
+			return &fakeHostConn{host: h}, nil
+		},
+	}
+}
+
+type fakeHostConn struct {
+	host    *fakeHost
+	pending []string
+}
+
+func (c *fakeHostConn) Close() error { return nil }
+func (c *fakeHostConn) Err() error   { return nil }
+func (c *fakeHostConn) Flush() error { return nil }
+func (c *fakeHostConn) Send(cmd string, args ...interface{}) error {
+	c.host.sends++
+	c.pending = append(c.pending, cmd)
+	return nil
+}
+func (c *fakeHostConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return "PONG", nil
+}
+func (c *fakeHostConn) Receive() (interface{}, error) {
+	if c.host.wait != nil {
+		<-c.host.wait
+	}
+	cmd := c.pending[0]
+	c.pending = c.pending[1:]
+	if c.host.reply != nil {
+		return nil, c.host.reply
+	}
+	if cmd == "LLEN" {
+		return c.host.length, nil
+	}
+	if cmd == "PUBLISH" && c.host.noSubscribers {
+		return int64(0), nil
+	}
+	return int64(1), nil
+}
+
+func newTestPools(hc *healthConfig, hosts ...*fakeHost) *redisPools {
+	rp := &redisPools{healthConfig: hc}
+	for i, h := range hosts {
+		addr := fmt.Sprintf("10.0.0.%d:6379", i+1)
+		rp.pools = append(rp.pools, h.pool(addr))
+		rp.hosts = append(rp.hosts, addr)
+		rp.health = append(rp.health, &poolHealth{})
+	}
+	return rp
+}
+
+func TestGetHealthConfig(t *testing.T) {
+	hc, err := getHealthConfig("", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, &healthConfig{failures: 3, backoff: time.Second, maxBackoff: time.Minute, interval: time.Second}, hc)
+
+	hc, err = getHealthConfig("1", "5s", "5m", "500ms")
+	require.NoError(t, err)
+	assert.Equal(t, &healthConfig{failures: 1, backoff: 5 * time.Second, maxBackoff: 5 * time.Minute, interval: 500 * time.Millisecond}, hc)
+
+	_, err = getHealthConfig("a", "", "", "")
+	assert.EqualError(t, err, "ejectafterfailures must be a integer: strconv.Atoi: parsing \"a\": invalid syntax")
+	_, err = getHealthConfig("0", "", "", "")
+	assert.EqualError(t, err, "ejectafterfailures must be at least 1 but is:0")
+	_, err = getHealthConfig("", "1", "", "")
+	assert.EqualError(t, err, "ejectbackoff must be a duration: time: missing unit in duration \"1\"")
+	_, err = getHealthConfig("", "2m", "1m", "")
+	assert.EqualError(t, err, "ejectbackoff must be positive and not greater than ejectmaxbackoff but is:2m0s")
+	_, err = getHealthConfig("", "", "", "0s")
+	assert.EqualError(t, err, "healthcheckinterval must be positive but is:0s")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"EjectAfterFailures": "-1"}.get)
+	assert.EqualError(t, err, "ejectafterfailures must be at least 1 but is:-1")
+}
+
+func TestPoolHealthEject(t *testing.T) {
+	hc := &healthConfig{failures: 2, backoff: time.Second, maxBackoff: 3 * time.Second, interval: time.Second}
+	h := &poolHealth{}
+
+	assert.False(t, h.failure(hc))
+	assert.False(t, h.isEjected(), "one failure should not eject")
+	h.success()
+	assert.False(t, h.failure(hc), "a success should reset the consecutive failures")
+	assert.True(t, h.failure(hc))
+	assert.True(t, h.isEjected())
+	assert.False(t, h.probeDue(time.Now()), "the probe should wait for the backoff")
+	assert.True(t, h.probeDue(time.Now().Add(time.Second)))
+
+	assert.Equal(t, 2*time.Second, h.probeFailed(hc))
+	assert.Equal(t, 3*time.Second, h.probeFailed(hc), "the backoff should be limited by the max backoff")
+
+	h.success()
+	assert.False(t, h.isEjected())
+	assert.Equal(t, int64(2), h.successes)
+	assert.Equal(t, int64(5), h.failures)
+}
+
+func TestRedisSendFailover(t *testing.T) {
+	down, up := &fakeHost{}, &fakeHost{up: true}
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logs"),
+		pools: newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, down, up),
+	}
+	values := []*logmessage{
+		{data: []byte("test1")},
+		{data: []byte("test2")},
+	}
+
+	// all hosts are down, every host is tried regardless of the order
+	up.up = false
+	err := rc.send(values)
+	assert.Error(t, err)
+	assert.False(t, isPermanent(err), "a flush should be retried if all hosts failed")
+	assert.True(t, rc.pools.health[0].isEjected(), "the failed host should be ejected")
+	assert.True(t, rc.pools.health[1].isEjected(), "the failed host should be ejected")
+	assert.Len(t, rc.pools.candidates(), 2, "all hosts are tried if all are ejected")
+
+	up.up = true
+	for i := 0; i < 3; i++ {
+		require.NoError(t, rc.send(values), "the batch should be sent to the healthy host")
+	}
+	assert.Equal(t, 6, up.sends)
+	assert.True(t, rc.pools.health[0].isEjected(), "the failed host should stay ejected")
+	assert.False(t, rc.pools.health[1].isEjected(), "the host should be healthy again")
+	assert.Equal(t, []int{1}, rc.pools.candidates())
+}
+
+func TestRedisSendNoFailoverWithoutSubscribers(t *testing.T) {
+	a, b := &fakeHost{up: true, noSubscribers: true}, &fakeHost{up: true, noSubscribers: true}
+	rc := &redisClient{
+		key:           mustKeyTemplate(t, "logs"),
+		dataType:      dataTypeChannel,
+		noSubscribers: noSubscribersRetry,
+		pools:         newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, a, b),
+	}
+
+	err := rc.send([]*logmessage{{data: []byte("test1")}})
+	assert.ErrorIs(t, err, errNoSubscribers)
+	assert.Equal(t, 1, a.sends+b.sends, "the log must not be published on the other host again")
+	assert.False(t, rc.pools.health[0].isEjected(), "a host without subscribers is healthy")
+	assert.False(t, rc.pools.health[1].isEjected(), "a host without subscribers is healthy")
+}
+
+func TestRedisSendNoFailoverOnPermanentError(t *testing.T) {
+	wrongType := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	a, b := &fakeHost{up: true, reply: wrongType}, &fakeHost{up: true, reply: wrongType}
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logs"),
+		pools: newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, a, b),
+	}
+
+	// a record which is rejected is not the fault of the host
+	err := rc.send([]*logmessage{{data: []byte("test1")}})
+	assert.True(t, isPermanent(err), "a rejected record should not be retried")
+	assert.Equal(t, 1, a.sends+b.sends, "a rejected record should not be sent to the next host")
+	assert.False(t, rc.pools.health[0].isEjected())
+	assert.False(t, rc.pools.health[1].isEjected())
+}
+
+func TestPoolsProbe(t *testing.T) {
+	h := &fakeHost{}
+	rp := newTestPools(&healthConfig{failures: 1, backoff: time.Millisecond, maxBackoff: time.Second, interval: time.Millisecond}, h)
+	rp.failure(0, fmt.Errorf("connection refused"))
+	require.True(t, rp.health[0].isEjected())
+
+	time.Sleep(2 * time.Millisecond)
+	rp.probe()
+	assert.True(t, rp.health[0].isEjected(), "a failed probe should keep the host ejected")
+	assert.Equal(t, 2*time.Millisecond, rp.health[0].backoff)
+
+	h.up = true
+	time.Sleep(3 * time.Millisecond)
+	rp.probe()
+	assert.False(t, rp.health[0].isEjected(), "a successful probe should reinstate the host")
+
+	rp.startProbe()
+	rp.closeAll()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schemes of redis urls in hosts, rediss connects with tls.
+const (
+	redisScheme    = "redis"
+	redisTLSScheme = "rediss"
+)
+
+func isRedisURL(host string) bool {
+	return strings.HasPrefix(host, redisScheme+"://") || strings.HasPrefix(host, redisTLSScheme+"://")
+}
+
+// getRedisURL parses a host of the form redis[s]://[[user]:password@]host[:port][/db][?timeout=2s].
+// Settings which are not part of the url are taken from defaults.
+func getRedisURL(rawURL string, defaults redisHost) (redisHost, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// the error of url.Parse contains the password
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return redisHost{}, fmt.Errorf("hosts contains an invalid url: %w", err)
+	}
+	rh := defaults
+	rh.scheme = u.Scheme
+	rh.usetls = u.Scheme == redisTLSScheme
+
+	host := u.Host
+	if host == "" {
+		host = "localhost"
+	}
+	addr, err := getRedisHost(host)
+	if err != nil {
+		return redisHost{}, err
+	}
+	rh.hostname, rh.port = addr.hostname, addr.port
+
+	if u.User != nil {
+		rh.credentials = true
+		rh.username = ""
+		password, ok := u.User.Password()
+		if ok {
+			rh.username = u.User.Username()
+			rh.password = password
+		} else {
+			// redis-cli treats a single user info as password
+			rh.password = u.User.Username()
+		}
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		rh.db, err = strconv.Atoi(db)
+		if err != nil {
+			return redisHost{}, fmt.Errorf("db must be a integer: %w", err)
+		}
+	}
+
+	query := u.Query()
+	params := make([]string, 0, len(query))
+	for param := range query {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		value := query.Get(param)
+		switch param {
+		case "timeout":
+			rh.timeout, err = time.ParseDuration(value)
+			if err != nil {
+				return redisHost{}, fmt.Errorf("timeout must be a duration: %w", err)
+			}
+			if rh.timeout <= 0 {
+				return redisHost{}, fmt.Errorf("timeout must be positive but is:%s", rh.timeout)
+			}
+		default:
+			return redisHost{}, fmt.Errorf("hosts contains an url with unknown parameter:%s", param)
+		}
+	}
+	return rh, nil
+}
+
+// redactedURL returns the url of the host without password.
+func (h redisHost) redactedURL() string {
+	u := url.URL{Scheme: h.scheme, Host: h.address(), Path: "/" + strconv.Itoa(h.db)}
+	if h.username != "" {
+		u.User = url.User(h.username)
+	}
+	if h.timeout > 0 {
+		u.RawQuery = "timeout=" + h.timeout.String()
+	}
+	return u.String()
+}
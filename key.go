@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// defaultKeyFallback replaces placeholders whose field is missing in the record.
+	defaultKeyFallback = "unknown"
+	// tagField is the placeholder name of the tag passed to FLBPluginFlush.
+	tagField = "tag"
+)
+
+// A keyTemplate is a key with placeholders which is resolved for every record.
+//
+// Placeholders have the form ${field}, where field is either "tag" or a dot
+// separated path to a value in the record, e.g. ${kubernetes.namespace_name}.
+// ${field:-default} uses default if the field is missing, otherwise the
+// fallback is used.
+//
+// Logstash style time placeholders of the form %{+YYYY.MM.dd} are replaced by
+// the timestamp of the record in UTC.
+type keyTemplate struct {
+	parts    []keyPart
+	fallback string
+}
+
+// A keyPart is either a literal, a time or a field placeholder.
+type keyPart struct {
+	literal string
+	// layout of the record timestamp, "" if this is no time placeholder
+	layout string
+	// path to the value in the record, nil for literals
+	path []string
+	// def is used instead of the fallback if the field is missing
+	def    string
+	hasDef bool
+}
+
+func newKeyTemplate(key, fallback string) (*keyTemplate, error) {
+	if fallback == "" {
+		fallback = defaultKeyFallback
+	}
+	kt := &keyTemplate{fallback: fallback}
+
+	// @tag is supported for compatibility
+	rest := strings.ReplaceAll(key, tagPlaceholder, "${"+tagField+"}")
+	for rest != "" {
+		start := nextPlaceholder(rest)
+		if start < 0 {
+			kt.parts = append(kt.parts, keyPart{literal: rest})
+			break
+		}
+		if start > 0 {
+			kt.parts = append(kt.parts, keyPart{literal: rest[:start]})
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("key contains an unterminated placeholder:%s", key)
+		}
+		var (
+			part keyPart
+			err  error
+		)
+		if rest[start] == '%' {
+			part, err = newTimeKeyPart(rest[start+2 : start+end])
+		} else {
+			part, err = newKeyPart(rest[start+2 : start+end])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key contains an invalid placeholder in %s: %w", key, err)
+		}
+		kt.parts = append(kt.parts, part)
+		rest = rest[start+end+1:]
+	}
+	return kt, nil
+}
+
+// nextPlaceholder returns the index of the next ${ or %{ in key, or -1.
+func nextPlaceholder(key string) int {
+	field := strings.Index(key, "${")
+	tm := strings.Index(key, "%{")
+	if field < 0 || (tm >= 0 && tm < field) {
+		return tm
+	}
+	return field
+}
+
+// jodaLayout maps the date format tokens used by logstash to go layouts,
+// longer tokens must come first.
+var jodaLayout = []struct {
+	token  string
+	layout string
+}{
+	{"YYYY", "2006"},
+	{"yyyy", "2006"},
+	{"YY", "06"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+	{"mm", "04"},
+	{"ss", "05"},
+}
+
+func newTimeKeyPart(placeholder string) (keyPart, error) {
+	if !strings.HasPrefix(placeholder, "+") || len(placeholder) == 1 {
+		return keyPart{}, fmt.Errorf("time format must be in the form +YYYY.MM.dd but is:%s", placeholder)
+	}
+	format := placeholder[1:]
+	var layout strings.Builder
+outer:
+	for format != "" {
+		for _, j := range jodaLayout {
+			if strings.HasPrefix(format, j.token) {
+				layout.WriteString(j.layout)
+				format = format[len(j.token):]
+				continue outer
+			}
+		}
+		// letters and digits would be interpreted as go layout
+		r := rune(format[0])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return keyPart{}, fmt.Errorf("time format contains unknown token at %q:%s", format, placeholder)
+		}
+		layout.WriteByte(format[0])
+		format = format[1:]
+	}
+	return keyPart{layout: layout.String()}, nil
+}
+
+func newKeyPart(placeholder string) (keyPart, error) {
+	part := keyPart{}
+	field := placeholder
+	if i := strings.Index(placeholder, ":-"); i >= 0 {
+		field = placeholder[:i]
+		part.def = placeholder[i+2:]
+		part.hasDef = true
+	}
+	if field == "" {
+		return part, fmt.Errorf("field name is empty")
+	}
+	part.path = strings.Split(field, ".")
+	for _, p := range part.path {
+		if p == "" {
+			return part, fmt.Errorf("field %q contains an empty path element", field)
+		}
+	}
+	return part, nil
+}
+
+// resolve returns the key for the message.
+func (kt *keyTemplate) resolve(v *logmessage) string {
+	if kt == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, part := range kt.parts {
+		if part.layout != "" {
+			sb.WriteString(v.timestamp.UTC().Format(part.layout))
+			continue
+		}
+		if part.path == nil {
+			sb.WriteString(part.literal)
+			continue
+		}
+		value, ok := part.lookup(v)
+		switch {
+		case ok:
+			sb.WriteString(value)
+		case part.hasDef:
+			sb.WriteString(part.def)
+		default:
+			sb.WriteString(kt.fallback)
+		}
+	}
+	return sb.String()
+}
+
+// lookup returns the value of the placeholder in the message, only scalar
+// values are used.
+func (part keyPart) lookup(v *logmessage) (string, bool) {
+	if len(part.path) == 1 && part.path[0] == tagField {
+		return v.tag, v.tag != ""
+	}
+	var value interface{} = v.record
+	for _, p := range part.path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = m[p]
+		if !ok {
+			return "", false
+		}
+	}
+	switch t := value.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	case string:
+		return t, t != ""
+	default:
+		return fmt.Sprintf("%v", t), true
+	}
+}
+
+// A keyBatch holds all messages which are stored at the same key.
+type keyBatch struct {
+	key    string
+	values []*logmessage
+	// indexes holds the position of every message in the flush
+	indexes []int
+}
+
+// groupByKey splits the messages by their resolved key, the order of the keys and
+// of the messages per key is kept.
+func (kt *keyTemplate) groupByKey(values []*logmessage) []*keyBatch {
+	var batches []*keyBatch
+	index := make(map[string]*keyBatch)
+	for i, v := range values {
+		key := kt.resolve(v)
+		b, ok := index[key]
+		if !ok {
+			b = &keyBatch{key: key}
+			index[key] = b
+			batches = append(batches, b)
+		}
+		b.values = append(b.values, v)
+		b.indexes = append(b.indexes, i)
+	}
+	return batches
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustKeyTemplate(t testing.TB, key string) *keyTemplate {
+	kt, err := newKeyTemplate(key, "")
+	require.NoError(t, err)
+	return kt
+}
+
+func TestKeyTemplate(t *testing.T) {
+	v := &logmessage{
+		tag: "kube.var.log",
+		record: map[string]interface{}{
+			"five":  5,
+			"empty": "",
+			"kubernetes": map[string]interface{}{
+				"namespace_name": "default",
+				"labels":         map[string]interface{}{"app": "nginx"},
+			},
+		},
+	}
+
+	tests := []struct {
+		key      string
+		fallback string
+		want     string
+	}{
+		{key: "logstash", want: "logstash"},
+		{key: "logs:@tag", want: "logs:kube.var.log"},
+		{key: "logs:${tag}:${kubernetes.namespace_name}", want: "logs:kube.var.log:default"},
+		{key: "${kubernetes.labels.app}-${five}", want: "nginx-5"},
+		{key: "logs:${kubernetes.pod_name}", want: "logs:unknown"},
+		{key: "logs:${kubernetes.pod_name}", fallback: "none", want: "logs:none"},
+		{key: "logs:${kubernetes.pod_name:-nopod}", want: "logs:nopod"},
+		{key: "logs:${empty:-}", want: "logs:"},
+		{key: "logs:${kubernetes.labels}", want: "logs:unknown"},
+		{key: "logs:${five.six}", want: "logs:unknown"},
+	}
+	for _, tt := range tests {
+		kt, err := newKeyTemplate(tt.key, tt.fallback)
+		if assert.NoError(t, err, tt.key) {
+			assert.Equal(t, tt.want, kt.resolve(v), tt.key)
+		}
+	}
+
+	// invalid templates
+	_, err := newKeyTemplate("logs:${tag", "")
+	assert.EqualError(t, err, "key contains an unterminated placeholder:logs:${tag")
+
+	_, err = newKeyTemplate("logs:${}", "")
+	assert.EqualError(t, err, "key contains an invalid placeholder in logs:${}: field name is empty")
+
+	_, err = newKeyTemplate("logs-%{YYYY}", "")
+	assert.EqualError(t, err, "key contains an invalid placeholder in logs-%{YYYY}: time format must be in the form +YYYY.MM.dd but is:YYYY")
+
+	_, err = newKeyTemplate("logs-%{+YYYY.MMM}", "")
+	assert.EqualError(t, err, "key contains an invalid placeholder in logs-%{+YYYY.MMM}: time format contains unknown token at \"M\":+YYYY.MMM")
+
+	_, err = newKeyTemplate("logs:${a..b}", "")
+	assert.EqualError(t, err, "key contains an invalid placeholder in logs:${a..b}: field \"a..b\" contains an empty path element")
+}
+
+func TestTimeBucketKeyTemplate(t *testing.T) {
+	v := &logmessage{
+		tag:       "nginx",
+		timestamp: time.Date(2026, time.October, 18, 23, 59, 58, 0, time.FixedZone("CEST", 2*60*60)),
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "logstash-%{+YYYY.MM.dd}", want: "logstash-2026.10.18"},
+		{key: "logstash-%{+yyyy.MM.dd.HH}", want: "logstash-2026.10.18.21"},
+		{key: "logs:${tag}:%{+YY-MM-dd_HH:mm:ss}", want: "logs:nginx:26-10-18_21:59:58"},
+	}
+	for _, tt := range tests {
+		kt, err := newKeyTemplate(tt.key, "")
+		if assert.NoError(t, err, tt.key) {
+			assert.Equal(t, tt.want, kt.resolve(v), tt.key)
+		}
+	}
+}
+
+func TestGroupByKey(t *testing.T) {
+	kt := mustKeyTemplate(t, "logs:${tag}")
+	values := []*logmessage{
+		{data: []byte("1"), tag: "b"},
+		{data: []byte("2"), tag: "a"},
+		{data: []byte("3"), tag: "b"},
+	}
+	batches := kt.groupByKey(values)
+	assert.Len(t, batches, 2, "there should be one batch per key")
+	assert.Equal(t, "logs:b", batches[0].key)
+	assert.Equal(t, []*logmessage{values[0], values[2]}, batches[0].values)
+	assert.Equal(t, "logs:a", batches[1].key)
+	assert.Equal(t, []*logmessage{values[1]}, batches[1].values)
+}
+
+func TestRedisSendGroupedByKey(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logs:${kubernetes.namespace_name}")}
+	values := []*logmessage{
+		{data: []byte("1"), record: map[string]interface{}{"kubernetes": map[string]interface{}{"namespace_name": "a"}}},
+		{data: []byte("2"), record: map[string]interface{}{"kubernetes": map[string]interface{}{"namespace_name": "b"}}},
+		{data: []byte("3"), record: map[string]interface{}{"kubernetes": map[string]interface{}{"namespace_name": "a"}}},
+	}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", values)
+	assert.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "logs:a", []byte("1")},
+		{"RPUSH", "logs:a", []byte("3")},
+		{"RPUSH", "logs:b", []byte("2")},
+	}, conn.commands)
+}
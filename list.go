@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	pushDirectionRight = "right"
+	pushDirectionLeft  = "left"
+)
+
+// A listConfig holds the options used when records are written to a list.
+type listConfig struct {
+	// maxLen trims the list to at most this many entries after every flush,
+	// the oldest entries are dropped. 0 disables it.
+	maxLen int64
+	// direction is pushDirectionRight for RPUSH or pushDirectionLeft for LPUSH.
+	direction string
+
+	// evicted counts the entries dropped by LTRIM since the start.
+	evicted int64
+}
+
+func (lc *listConfig) String() string {
+	return fmt.Sprintf("maxlength:%d pushdirection:%s", lc.maxLen, lc.direction)
+}
+
+// getListConfig parses the list options, nil is returned for the defaults.
+func getListConfig(maxlength, direction string) (*listConfig, error) {
+	lc := &listConfig{direction: pushDirectionRight}
+	if maxlength != "" {
+		maxLen, err := strconv.ParseInt(maxlength, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maxlength must be a integer: %w", err)
+		}
+		if maxLen < 0 {
+			return nil, fmt.Errorf("maxlength must not be negative:%d", maxLen)
+		}
+		lc.maxLen = maxLen
+	}
+	if direction != "" {
+		lc.direction = strings.ToLower(direction)
+	}
+	if lc.direction != pushDirectionRight && lc.direction != pushDirectionLeft {
+		return nil, fmt.Errorf("pushdirection must be one of %s or %s but is:%s", pushDirectionRight, pushDirectionLeft, lc.direction)
+	}
+	if lc.maxLen == 0 && lc.direction == pushDirectionRight {
+		return nil, nil
+	}
+	return lc, nil
+}
+
+// push returns the command which adds an entry to the list.
+func (lc *listConfig) push() string {
+	if lc != nil && lc.direction == pushDirectionLeft {
+		return "LPUSH"
+	}
+	return "RPUSH"
+}
+
+// capped returns true if the list is trimmed after every flush.
+func (lc *listConfig) capped() bool {
+	return lc != nil && lc.maxLen > 0
+}
+
+// ltrimArgs returns the arguments of LTRIM which keeps the newest maxLen
+// entries of the list at key, they are at the end the entries are pushed to.
+func (lc *listConfig) ltrimArgs(key string) []interface{} {
+	if lc.direction == pushDirectionLeft {
+		return []interface{}{key, 0, lc.maxLen - 1}
+	}
+	return []interface{}{key, -lc.maxLen, -1}
+}
+
+// reportEvicted logs how many entries were dropped by the LTRIM commands.
+// The length of a list is the reply to its last push before the LTRIM.
+func (lc *listConfig) reportEvicted(cmds []*command) {
+	if !lc.capped() {
+		return
+	}
+	var length int64
+	for _, c := range cmds {
+		switch c.op() {
+		case "RPUSH", "LPUSH":
+			// a push skipped as duplicate has no length
+			if n := atomic.LoadInt64(&c.length); n > 0 {
+				length = n
+			}
+		case "LTRIM":
+			evicted := length - lc.maxLen
+			length = 0
+			if evicted <= 0 {
+				continue
+			}
+			total := atomic.AddInt64(&lc.evicted, evicted)
+			fmt.Printf("[out-redis] key %s is capped at %d entries, evicted %d entries, %d in total\n", c.key, lc.maxLen, evicted, total)
+		}
+	}
+}
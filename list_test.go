@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetListConfig(t *testing.T) {
+	lc, err := getListConfig("", "")
+	require.NoError(t, err)
+	assert.Nil(t, lc, "no list config expected by default")
+
+	lc, err = getListConfig("1000", "")
+	require.NoError(t, err)
+	assert.Equal(t, &listConfig{maxLen: 1000, direction: pushDirectionRight}, lc)
+
+	lc, err = getListConfig("", "Left")
+	require.NoError(t, err)
+	assert.Equal(t, &listConfig{direction: pushDirectionLeft}, lc)
+
+	// invalid configurations
+	_, err = getListConfig("a", "")
+	assert.EqualError(t, err, "maxlength must be a integer: strconv.ParseInt: parsing \"a\": invalid syntax")
+	_, err = getListConfig("-1", "")
+	assert.EqualError(t, err, "maxlength must not be negative:-1")
+	_, err = getListConfig("", "up")
+	assert.EqualError(t, err, "pushdirection must be one of right or left but is:up")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "stream", "MaxLength": "10"}.get)
+	assert.EqualError(t, err, "maxlength and pushdirection can only be used with datatype list")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"MaxLength": "10"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list list:{maxlength:10 pushdirection:right}", c.String())
+}
+
+func TestRedisSendCapped(t *testing.T) {
+	rc := &redisClient{
+		key:  mustKeyTemplate(t, "logstash-${tag}"),
+		list: &listConfig{maxLen: 3, direction: pushDirectionRight},
+	}
+	values := []*logmessage{
+		{data: []byte("1"), tag: "a"},
+		{data: []byte("2"), tag: "b"},
+		{data: []byte("3"), tag: "a"},
+	}
+	// the replies of RPUSH are the lengths of the lists
+	conn := &recordingConnection{replies: []interface{}{int64(4), int64(5), "OK", int64(2), "OK"}}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"RPUSH", "logstash-a", []byte("1")},
+		{"RPUSH", "logstash-a", []byte("3")},
+		{"LTRIM", "logstash-a", int64(-3), -1},
+		{"RPUSH", "logstash-b", []byte("2")},
+		{"LTRIM", "logstash-b", int64(-3), -1},
+	}, conn.commands)
+	assert.Equal(t, int64(2), rc.list.evicted, "the two oldest entries of logstash-a are evicted")
+
+	conn = &recordingConnection{replies: []interface{}{int64(4), "OK"}}
+	err = rc.sendImpl(conn, "", values[:1])
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rc.list.evicted)
+}
+
+func TestRedisSendCappedLeft(t *testing.T) {
+	rc := &redisClient{
+		key:  mustKeyTemplate(t, "logstash"),
+		list: &listConfig{maxLen: 3, direction: pushDirectionLeft},
+	}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", []*logmessage{{data: []byte("1")}})
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"LPUSH", "logstash", []byte("1")},
+		{"LTRIM", "logstash", 0, int64(2)},
+	}, conn.commands)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"C"
 	"fmt"
+	"sync"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
@@ -13,12 +14,15 @@ import (
 )
 
 var (
-	rc   *redisClient
 	json = jsoniter.ConfigCompatibleWithStandardLibrary
 	// both variables are set in Makefile
 	revision  string
 	builddate string
 	plugin    Plugin = &fluentPlugin{}
+
+	// clients holds the redis client of every output instance until it exits
+	clients   []*redisClient
+	clientsMu sync.Mutex
 )
 
 //export FLBPluginRegister
@@ -28,14 +32,22 @@ func FLBPluginRegister(ctx unsafe.Pointer) int {
 
 type logmessage struct {
 	data []byte
+	// record holds the parsed record including @timestamp and @tag
+	record    map[string]interface{}
+	tag       string
+	timestamp time.Time
+	// receivers is the number of subscribers which received a published message
+	receivers int64
 }
 
 type Plugin interface {
 	Environment(ctx unsafe.Pointer, key string) string
+	SetContext(ctx unsafe.Pointer, rc *redisClient)
+	GetContext(ctx unsafe.Pointer) *redisClient
 	Unregister(ctx unsafe.Pointer)
 	GetRecord(dec *output.FLBDecoder) (ret int, ts interface{}, rec map[interface{}]interface{})
 	NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder
-	Send(values []*logmessage) error
+	Send(rc *redisClient, values []*logmessage) error
 	Exit(code int)
 }
 
@@ -45,6 +57,15 @@ func (p *fluentPlugin) Environment(ctx unsafe.Pointer, key string) string {
 	return output.FLBPluginConfigKey(ctx, key)
 }
 
+func (p *fluentPlugin) SetContext(ctx unsafe.Pointer, rc *redisClient) {
+	output.FLBPluginSetContext(ctx, rc)
+}
+
+func (p *fluentPlugin) GetContext(ctx unsafe.Pointer) *redisClient {
+	rc, _ := output.FLBPluginGetContext(ctx).(*redisClient)
+	return rc
+}
+
 func (p *fluentPlugin) Unregister(ctx unsafe.Pointer) {
 	output.FLBPluginUnregister(ctx)
 }
@@ -61,23 +82,20 @@ func (p *fluentPlugin) Exit(code int) {
 	os.Exit(code)
 }
 
-func (p *fluentPlugin) Send(values []*logmessage) error {
-	return rc.send(values)
+func (p *fluentPlugin) Send(rc *redisClient, values []*logmessage) error {
+	return rc.deliver(values)
 }
 
 // ctx (context) pointer to fluentbit context (state/ c code)
 //
 //export FLBPluginInit
 func FLBPluginInit(ctx unsafe.Pointer) int {
-	hosts := plugin.Environment(ctx, "Hosts")
-	password := plugin.Environment(ctx, "Password")
-	key := plugin.Environment(ctx, "Key")
-	db := plugin.Environment(ctx, "DB")
-	usetls := plugin.Environment(ctx, "UseTLS")
-	tlsskipverify := plugin.Environment(ctx, "TLSSkipVerify")
+	env := func(key string) string {
+		return plugin.Environment(ctx, key)
+	}
 
 	// create a pool of redis connection pools
-	config, err := getRedisConfig(hosts, password, db, usetls, tlsskipverify, key)
+	config, err := getRedisConfigFromEnv(env)
 	if err != nil {
 		fmt.Printf("configuration errors: %v\n", err)
 		// FIXME use fluent-bit method to err in init
@@ -85,18 +103,27 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 		plugin.Exit(1)
 		return output.FLB_ERROR
 	}
-	rc = &redisClient{
-		pools: newPoolsFromConfig(config),
-		key:   config.key,
-	}
+	// every output instance has its own client
+	rc := newRedisClient(config)
+	rc.loadScript()
+	plugin.SetContext(ctx, rc)
+	clientsMu.Lock()
+	clients = append(clients, rc)
+	clientsMu.Unlock()
 	fmt.Printf("[out-redis] build:%s version:%s redis connection to: %s\n", builddate, revision, config)
 	return output.FLB_OK
 }
 
-// FLBPluginFlush is called from fluent-bit when data need to be sent. is called from fluent-bit when data need to be sent.
+// FLBPluginFlushCtx is called from fluent-bit when data of the output instance ctx need to be sent.
 //
-//export FLBPluginFlush
-func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
+//export FLBPluginFlushCtx
+func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
+	rc := plugin.GetContext(ctx)
+	if rc == nil {
+		fmt.Print("no redis client is initialized for this output instance\n")
+		return output.FLB_ERROR
+	}
+
 	var ret int
 	var ts interface{}
 	var record map[interface{}]interface{}
@@ -138,9 +165,12 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 		logs = append(logs, js)
 	}
 
-	err := plugin.Send(logs)
+	err := plugin.Send(rc, logs)
 	if err != nil {
 		fmt.Printf("%v\n", err)
+		if isPermanent(err) {
+			return output.FLB_ERROR
+		}
 		return output.FLB_RETRY
 	}
 
@@ -180,12 +210,39 @@ func createJSON(timestamp time.Time, tag string, record map[interface{}]interfac
 	if err != nil {
 		return nil, fmt.Errorf("error creating message for REDIS: %w", err)
 	}
-	return &logmessage{data: js}, nil
+	return &logmessage{data: js, record: m, tag: tag, timestamp: timestamp}, nil
 }
 
+// FLBPluginExitCtx is called from fluent-bit when the output instance ctx exits.
+//
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	rc := plugin.GetContext(ctx)
+	if rc == nil {
+		return output.FLB_OK
+	}
+	clientsMu.Lock()
+	for i, c := range clients {
+		if c == rc {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	clientsMu.Unlock()
+	rc.close()
+	return output.FLB_OK
+}
+
+// FLBPluginExit closes all output instances which are not closed by FLBPluginExitCtx.
+//
 //export FLBPluginExit
 func FLBPluginExit() int {
-	rc.pools.closeAll()
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, rc := range clients {
+		rc.close()
+	}
+	clients = nil
 	return output.FLB_OK
 }
 
@@ -6,6 +6,7 @@ import (
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,9 +75,13 @@ type testrecord struct {
 type testFluentPlugin struct {
 	hosts       string
 	db          string
+	options     map[string]string
 	records     []testrecord
 	position    int
 	logmessages []*logmessage
+	sendErr     error
+	contexts    map[unsafe.Pointer]*redisClient
+	sentBy      []*redisClient
 }
 
 func (p *testFluentPlugin) Environment(ctx unsafe.Pointer, key string) string {
@@ -94,13 +99,26 @@ func (p *testFluentPlugin) Environment(ctx unsafe.Pointer, key string) string {
 	case "TLSSkipVerify":
 		return "false"
 	}
-	return "unknown-" + key
+	return p.options[key]
 }
 
+func (p *testFluentPlugin) SetContext(ctx unsafe.Pointer, rc *redisClient) {
+	if p.contexts == nil {
+		p.contexts = make(map[unsafe.Pointer]*redisClient)
+	}
+	p.contexts[ctx] = rc
+}
+func (p *testFluentPlugin) GetContext(ctx unsafe.Pointer) *redisClient {
+	return p.contexts[ctx]
+}
 func (p *testFluentPlugin) Unregister(ctx unsafe.Pointer)                                 {}
 func (p *testFluentPlugin) NewDecoder(data unsafe.Pointer, length int) *output.FLBDecoder { return nil }
 func (p *testFluentPlugin) Exit(code int)                                                 {}
-func (p *testFluentPlugin) Send(values []*logmessage) error {
+func (p *testFluentPlugin) Send(rc *redisClient, values []*logmessage) error {
+	if p.sendErr != nil {
+		return p.sendErr
+	}
+	p.sentBy = append(p.sentBy, rc)
 	p.logmessages = append(p.logmessages, values...)
 	return nil
 }
@@ -117,10 +135,43 @@ func (p *testFluentPlugin) addrecord(rc int, ts interface{}, data map[interface{
 }
 
 func TestPluginInitialization(t *testing.T) {
-	plugin = &testFluentPlugin{hosts: "hosta hostb", db: "0"}
+	testplugin := &testFluentPlugin{hosts: "hosta hostb", db: "0"}
+	plugin = testplugin
 	res := FLBPluginInit(nil)
 	assert.Equal(t, output.FLB_OK, res)
-	assert.Len(t, rc.pools.pools, 2)
+	assert.Len(t, testplugin.GetContext(nil).pools.pools, 2)
+	assert.Equal(t, output.FLB_OK, FLBPluginExitCtx(nil))
+}
+
+func TestPluginMultipleInstances(t *testing.T) {
+	var audit, app int
+	testplugin := &testFluentPlugin{hosts: "audita auditb", db: "0"}
+	plugin = testplugin
+	assert.Equal(t, output.FLB_OK, FLBPluginInit(unsafe.Pointer(&audit)))
+	testplugin.hosts = "app"
+	assert.Equal(t, output.FLB_OK, FLBPluginInit(unsafe.Pointer(&app)))
+
+	auditClient := testplugin.GetContext(unsafe.Pointer(&audit))
+	appClient := testplugin.GetContext(unsafe.Pointer(&app))
+	assert.Equal(t, []string{"audita:6379", "auditb:6379"}, auditClient.pools.hosts, "the first instance should keep its hosts")
+	assert.Equal(t, []string{"app:6379"}, appClient.pools.hosts)
+
+	testplugin.addrecord(0, uint64(0), map[interface{}]interface{}{"mykey": "myvalue"})
+	assert.Equal(t, output.FLB_OK, FLBPluginFlushCtx(unsafe.Pointer(&audit), nil, 0, nil))
+	testplugin.position = 0
+	assert.Equal(t, output.FLB_OK, FLBPluginFlushCtx(unsafe.Pointer(&app), nil, 0, nil))
+	assert.Equal(t, []*redisClient{auditClient, appClient}, testplugin.sentBy, "every instance should send with its own client")
+
+	assert.Equal(t, output.FLB_OK, FLBPluginExitCtx(unsafe.Pointer(&audit)))
+	assert.NotContains(t, clients, auditClient, "an exited instance should be removed")
+	assert.Contains(t, clients, appClient)
+	assert.Equal(t, output.FLB_OK, FLBPluginExit())
+	assert.Empty(t, clients, "all instances should be closed on exit")
+}
+
+func TestPluginFlushWithoutInstance(t *testing.T) {
+	plugin = &testFluentPlugin{}
+	assert.Equal(t, output.FLB_ERROR, FLBPluginFlushCtx(nil, nil, 0, nil))
 }
 
 func TestPluginInitializationFailure(t *testing.T) {
@@ -138,8 +189,9 @@ func TestPluginFlusher(t *testing.T) {
 	testplugin.addrecord(0, output.FLBTime{Time: ts}, testrecords)
 	testplugin.addrecord(0, uint64(ts.Unix()), testrecords)
 	testplugin.addrecord(0, 0, testrecords)
+	testplugin.SetContext(nil, &redisClient{})
 	plugin = testplugin
-	res := FLBPluginFlush(nil, 0, nil)
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
 	assert.Equal(t, output.FLB_OK, res)
 	assert.Len(t, testplugin.logmessages, len(testplugin.records))
 	var parsed map[string]interface{}
@@ -154,3 +206,24 @@ func TestPluginFlusher(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEqual(t, ts.Format(time.RFC3339Nano), parsed["@timestamp"])
 }
+
+func TestPluginFlusherSendErrors(t *testing.T) {
+	ts := time.Date(2018, time.February, 10, 10, 11, 12, 0, time.UTC)
+	testrecords := map[interface{}]interface{}{
+		"mykey": "myvalue",
+	}
+
+	testplugin := &testFluentPlugin{sendErr: &sendError{host: "hosta:6379", record: 0, err: redis.Error("OOM command not allowed when used memory > 'maxmemory'")}}
+	testplugin.addrecord(0, output.FLBTime{Time: ts}, testrecords)
+	testplugin.SetContext(nil, &redisClient{})
+	plugin = testplugin
+	res := FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_RETRY, res, "a retryable error should be retried")
+
+	testplugin = &testFluentPlugin{sendErr: &sendError{host: "hosta:6379", record: 0, permanent: true, err: redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")}}
+	testplugin.addrecord(0, output.FLBTime{Time: ts}, testrecords)
+	testplugin.SetContext(nil, &redisClient{})
+	plugin = testplugin
+	res = FLBPluginFlushCtx(nil, nil, 0, nil)
+	assert.Equal(t, output.FLB_ERROR, res, "a permanent error should not be retried")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// A poolConfig defines the connection pool and the network timeouts of every host.
+type poolConfig struct {
+	maxIdle   int
+	maxActive int
+	// idleTimeout closes connections which are idle for this duration, 0 keeps them
+	idleTimeout time.Duration
+	// wait for a connection if maxActive connections are in use instead of failing
+	wait bool
+
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	// testOnBorrow pings a connection before use if it was idle for this duration
+	testOnBorrow time.Duration
+}
+
+var defaultPoolConfig = poolConfig{
+	maxIdle:        3,
+	idleTimeout:    240 * time.Second,
+	connectTimeout: 5 * time.Second,
+	readTimeout:    10 * time.Second,
+	writeTimeout:   10 * time.Second,
+	testOnBorrow:   time.Minute,
+}
+
+func getPoolConfig(maxIdle, maxActive, idleTimeout, wait, connectTimeout, readTimeout, writeTimeout, testOnBorrow string) (*poolConfig, error) {
+	pc := defaultPoolConfig
+	var err error
+	if pc.maxIdle, err = getPoolSize("maxidle", maxIdle, pc.maxIdle); err != nil {
+		return nil, err
+	}
+	if pc.maxActive, err = getPoolSize("maxactive", maxActive, pc.maxActive); err != nil {
+		return nil, err
+	}
+	if pc.maxActive > 0 && pc.maxIdle > pc.maxActive {
+		return nil, fmt.Errorf("maxidle must not be greater than maxactive but is:%d", pc.maxIdle)
+	}
+	if wait != "" {
+		pc.wait, err = strconv.ParseBool(wait)
+		if err != nil {
+			return nil, fmt.Errorf("wait must be a bool: %w", err)
+		}
+		if pc.wait && pc.maxActive == 0 {
+			return nil, fmt.Errorf("wait requires maxactive")
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		d     *time.Duration
+	}{
+		{"idletimeout", idleTimeout, &pc.idleTimeout},
+		{"connecttimeout", connectTimeout, &pc.connectTimeout},
+		{"readtimeout", readTimeout, &pc.readTimeout},
+		{"writetimeout", writeTimeout, &pc.writeTimeout},
+		{"testonborrowinterval", testOnBorrow, &pc.testOnBorrow},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		*d.d, err = getTimeout(d.name, d.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pc, nil
+}
+
+func getPoolSize(name, value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a integer: %w", name, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("%s must not be negative but is:%d", name, size)
+	}
+	return size, nil
+}
+
+// getTimeout parses the timeout either as seconds or as duration like 500ms, 0 disables it.
+func getTimeout(name, value string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("%s must not be negative:%s", name, value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be seconds or a duration: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative:%s", name, value)
+	}
+	return d, nil
+}
+
+func (pc *poolConfig) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "maxidle:%d maxactive:%d idletimeout:%s wait:%t", pc.maxIdle, pc.maxActive, pc.idleTimeout, pc.wait)
+	fmt.Fprintf(&sb, " connecttimeout:%s readtimeout:%s writetimeout:%s testonborrowinterval:%s", pc.connectTimeout, pc.readTimeout, pc.writeTimeout, pc.testOnBorrow)
+	return sb.String()
+}
+
+// dialOptions returns the timeouts, the timeout of a url overrides all of them.
+func (pc *poolConfig) dialOptions(timeout time.Duration) []redis.DialOption {
+	if pc == nil {
+		pc = &defaultPoolConfig
+	}
+	connect, read, write := pc.connectTimeout, pc.readTimeout, pc.writeTimeout
+	if timeout > 0 {
+		connect, read, write = timeout, timeout, timeout
+	}
+	return []redis.DialOption{
+		redis.DialConnectTimeout(connect),
+		redis.DialReadTimeout(read),
+		redis.DialWriteTimeout(write),
+	}
+}
+
+func newHostPool(host redisHost) *redis.Pool {
+	pc := host.pool
+	if pc == nil {
+		pc = &defaultPoolConfig
+	}
+	return &redis.Pool{
+		MaxIdle:     pc.maxIdle,
+		MaxActive:   pc.maxActive,
+		IdleTimeout: pc.idleTimeout,
+		Wait:        pc.wait,
+		Dial:        host.dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if err := host.reauth(c); err != nil {
+				return err
+			}
+			// 0 disables the check
+			if pc.testOnBorrow == 0 || time.Since(t) < pc.testOnBorrow {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
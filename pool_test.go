@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPoolConfig(t *testing.T) {
+	pc, err := getPoolConfig("", "", "", "", "", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, defaultPoolConfig, *pc)
+
+	pc, err = getPoolConfig("5", "10", "1m", "true", "500ms", "2", "3s", "0")
+	require.NoError(t, err)
+	assert.Equal(t, poolConfig{
+		maxIdle:        5,
+		maxActive:      10,
+		idleTimeout:    time.Minute,
+		wait:           true,
+		connectTimeout: 500 * time.Millisecond,
+		readTimeout:    2 * time.Second,
+		writeTimeout:   3 * time.Second,
+	}, *pc)
+
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"a", "", "", "", "", "", "", ""}, err: "maxidle must be a integer: strconv.Atoi: parsing \"a\": invalid syntax"},
+		{args: []string{"", "-1", "", "", "", "", "", ""}, err: "maxactive must not be negative but is:-1"},
+		{args: []string{"5", "2", "", "", "", "", "", ""}, err: "maxidle must not be greater than maxactive but is:5"},
+		{args: []string{"", "", "", "yes", "", "", "", ""}, err: "wait must be a bool: strconv.ParseBool: parsing \"yes\": invalid syntax"},
+		{args: []string{"", "", "", "true", "", "", "", ""}, err: "wait requires maxactive"},
+		{args: []string{"", "", "", "", "-1", "", "", ""}, err: "connecttimeout must not be negative:-1"},
+		{args: []string{"", "", "", "", "", "1x", "", ""}, err: "readtimeout must be seconds or a duration: time: unknown unit \"x\" in duration \"1x\""},
+		{args: []string{"", "", "", "", "", "", "", "-1s"}, err: "testonborrowinterval must not be negative:-1s"},
+	}
+	for _, tt := range tests {
+		_, err := getPoolConfig(tt.args[0], tt.args[1], tt.args[2], tt.args[3], tt.args[4], tt.args[5], tt.args[6], tt.args[7])
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestGetRedisConfigFromEnvPool(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list", c.String(), "the defaults should not be printed")
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"MaxActive": "10", "Wait": "true", "ReadTimeout": "1s"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list pool:{maxidle:3 maxactive:10 idletimeout:4m0s wait:true connecttimeout:5s readtimeout:1s writetimeout:10s testonborrowinterval:1m0s}", c.String())
+
+	pool := newHostPool(c.hosts[0])
+	assert.Equal(t, 10, pool.MaxActive)
+	assert.True(t, pool.Wait)
+	assert.Equal(t, 3, pool.MaxIdle)
+	assert.Equal(t, 240*time.Second, pool.IdleTimeout)
+}
+
+func TestReadTimeout(t *testing.T) {
+	// a hung redis accepts connections but never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	pc, err := getPoolConfig("", "", "", "", "", "50ms", "", "")
+	require.NoError(t, err)
+	pool := newHostPool(redisHost{hostname: "127.0.0.1", port: l.Addr().(*net.TCPAddr).Port, pool: pc})
+	defer pool.Close()
+
+	start := time.Now()
+	err = ping(pool)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "i/o timeout")
+	assert.Less(t, time.Since(start), 5*time.Second, "a hung redis should not block the flush")
+}
+
+func TestTestOnBorrow(t *testing.T) {
+	// the fake connection fails every PING
+	conn := &fakeSentinelConn{}
+	idle := time.Now().Add(-time.Hour)
+
+	pool := newHostPool(redisHost{hostname: "127.0.0.1", port: 6379, pool: &defaultPoolConfig})
+	assert.NoError(t, pool.TestOnBorrow(conn, time.Now()), "a recently used connection is not checked")
+	assert.EqualError(t, pool.TestOnBorrow(conn, idle), "unexpected command PING")
+
+	pc, err := getPoolConfig("", "", "", "", "", "", "", "0")
+	require.NoError(t, err)
+	pool = newHostPool(redisHost{hostname: "127.0.0.1", port: 6379, pool: pc})
+	assert.NoError(t, pool.TestOnBorrow(conn, idle), "0 disables the check")
+}
@@ -1,24 +1,141 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
+const (
+	dataTypeList    = "list"
+	dataTypeStream  = "stream"
+	dataTypeChannel = "channel"
+
+	// tagPlaceholder in the key is replaced by the tag of the record.
+	tagPlaceholder = "@tag"
+)
+
 type redisClient struct {
-	key   string
-	pools *redisPools
+	key           *keyTemplate
+	dataType      string
+	stream        *streamConfig
+	list          *listConfig
+	noSubscribers string
+	expiry        *keyExpiry
+	pools         *redisPools
+	cluster       *redisCluster
+	sentinel      *redisSentinel
+	writeMode     *writeMode
+	shardBy       *keyTemplate
+	credentials   *credentials
+	backpressure  *backpressure
+	// transactional wraps every flush in MULTI/EXEC
+	transactional bool
+	dedup         *dedup
+	script        *scriptConfig
+	batch         *batchConfig
+	spool         *spool
+	// writes tracks the replicated writes which are completed in the background
+	writes sync.WaitGroup
+}
+
+func newRedisClient(config *redisConfig) *redisClient {
+	rc := &redisClient{
+		key:           config.keyTemplate,
+		dataType:      config.dataType,
+		stream:        config.stream,
+		list:          config.list,
+		noSubscribers: config.noSubscribers,
+		expiry:        newKeyExpiry(config.keyExpire),
+		writeMode:     config.writeMode,
+		shardBy:       config.shardTemplate,
+		credentials:   config.credentials,
+		backpressure:  newBackpressure(config.watermarks, config.dataType),
+		transactional: config.transactional,
+		dedup:         newDedup(config.dedupWindow),
+		script:        config.script,
+		batch:         config.batch,
+		spool:         config.spool,
+	}
+	if rc.credentials != nil {
+		rc.credentials.start()
+	}
+	if rc.spool != nil {
+		rc.spool.start(rc.send)
+	}
+	switch {
+	case config.cluster:
+		rc.cluster = newClusterFromConfig(config)
+	case len(config.sentinelHosts) > 0:
+		rc.sentinel = newSentinelFromConfig(config)
+		rc.sentinel.start()
+	default:
+		rc.pools = newPoolsFromConfig(config)
+		rc.pools.startProbe()
+	}
+	return rc
 }
 
 type redisHost struct {
 	hostname string
 	port     int
+	// socket is the path of a unix domain socket, hostname and port are unused then
+	socket string
+
+	// the connection settings are either the global ones or set by a url
+	scheme        string
+	username      string
+	password      string
+	db            int
+	usetls        bool
+	tlsskipverify bool
+	timeout       time.Duration
+	// credentials is true if username and password are set by the url
+	credentials bool
+	clientName  string
+	// hello authenticates with HELLO instead of AUTH
+	hello bool
+	// creds override username and password if they are read from files
+	creds *credentials
+	tls   *tlsOptions
+	pool  *poolConfig
 }
+
+// unixScheme is the prefix of unix domain sockets in hosts.
+const unixScheme = "unix://"
+
+func (h redisHost) network() string {
+	if h.socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// address returns the address to dial, ipv6 addresses are enclosed in brackets.
+func (h redisHost) address() string {
+	if h.socket != "" {
+		return h.socket
+	}
+	return net.JoinHostPort(h.hostname, strconv.Itoa(h.port))
+}
+
+func (h redisHost) String() string {
+	if h.scheme != "" {
+		return "{" + h.redactedURL() + "}"
+	}
+	if h.socket != "" {
+		return "{" + unixScheme + h.socket + "}"
+	}
+	return fmt.Sprintf("{%s %d}", h.hostname, h.port)
+}
+
 type redisConfig struct {
 	hosts         []redisHost
 	db            int
@@ -26,15 +143,53 @@ type redisConfig struct {
 	usetls        bool
 	tlsskipverify bool
 	key           string
+	keyTemplate   *keyTemplate
+	keyExpire     time.Duration
+	watermarks    *watermarks
+	dataType      string
+	stream        *streamConfig
+	list          *listConfig
+	noSubscribers string
+	transactional bool
+	dedupWindow   time.Duration
+	script        *scriptConfig
+	batch         *batchConfig
+	spool         *spool
+	cluster       bool
+	// the hosts are ignored if the master is resolved by sentinels
+	sentinelHosts    []string
+	sentinelMaster   string
+	sentinelPassword string
+	username         string
+	clientName       string
+	hello            bool
+	credentials      *credentials
+	tls              *tlsOptions
+	pool             *poolConfig
+	health           *healthConfig
+	writeMode        *writeMode
+	shardBy          string
+	shardTemplate    *keyTemplate
+	loadBalancing    string
 }
 type redisPools struct {
 	pools []*redis.Pool
+	// hosts holds the address of every pool
+	hosts []string
+	// health tracks every pool, failing pools are ejected
+	health       []*poolHealth
+	healthConfig *healthConfig
+	balancer     balancer
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 // An asyncConnection allows us to write unit testw without redis.
 type asyncConnection interface {
 	Send(string, ...interface{}) error
 	Flush() error
+	Receive() (interface{}, error)
 }
 
 // A redisConn implements an async connection with redis.
@@ -50,8 +205,326 @@ func (r *redisConn) Flush() error {
 	return r.conn.Flush()
 }
 
+func (r *redisConn) Receive() (interface{}, error) {
+	return r.conn.Receive()
+}
+
 func (rc *redisConfig) String() string {
-	return fmt.Sprintf("hosts:%v db:%d usetls:%t tlsskipverify:%t key:%s", rc.hosts, rc.db, rc.usetls, rc.tlsskipverify, rc.key)
+	s := fmt.Sprintf("hosts:%v db:%d usetls:%t tlsskipverify:%t key:%s datatype:%s", rc.hosts, rc.db, rc.usetls, rc.tlsskipverify, rc.key, rc.dataType)
+	if rc.stream != nil {
+		s += fmt.Sprintf(" stream:{%s}", rc.stream)
+	}
+	if rc.list != nil {
+		s += fmt.Sprintf(" list:{%s}", rc.list)
+	}
+	if rc.dataType == dataTypeChannel {
+		s += fmt.Sprintf(" nosubscribers:%s", rc.noSubscribers)
+	}
+	if rc.keyExpire > 0 {
+		s += fmt.Sprintf(" keyexpire:%s", rc.keyExpire)
+	}
+	if rc.watermarks != nil {
+		s += fmt.Sprintf(" %s", rc.watermarks)
+	}
+	if rc.transactional {
+		s += " transactional:true"
+	}
+	if rc.dedupWindow > 0 {
+		s += fmt.Sprintf(" dedupwindow:%s", rc.dedupWindow)
+	}
+	if rc.script != nil {
+		s += fmt.Sprintf(" script:{%s}", rc.script)
+	}
+	if rc.spool != nil {
+		s += fmt.Sprintf(" %s", rc.spool)
+	}
+	if rc.batch != nil && (rc.batch.size != defaultBatchSize || rc.batch.bytes != defaultBatchBytes) {
+		s += fmt.Sprintf(" %s", rc.batch)
+	}
+	if rc.cluster {
+		s += " cluster:true"
+	}
+	if len(rc.sentinelHosts) > 0 {
+		s += fmt.Sprintf(" sentinelhosts:%v sentinelmaster:%s", rc.sentinelHosts, rc.sentinelMaster)
+	}
+	if rc.writeMode.replicated() {
+		s += fmt.Sprintf(" writemode:%s", rc.writeMode)
+	}
+	if rc.shardBy != "" {
+		s += fmt.Sprintf(" shardby:%s", rc.shardBy)
+	}
+	if rc.loadBalancing != loadBalancingRandom {
+		s += fmt.Sprintf(" loadbalancing:%s", rc.loadBalancing)
+	}
+	if rc.credentials != nil {
+		s += fmt.Sprintf(" usernamefile:%s passwordfile:%s", rc.credentials.usernameFile, rc.credentials.passwordFile)
+	} else if rc.username != "" {
+		s += fmt.Sprintf(" username:%s", rc.username)
+	}
+	if rc.clientName != "" {
+		s += fmt.Sprintf(" clientname:%s", rc.clientName)
+	}
+	if rc.tls != nil {
+		s += rc.tls.String()
+	}
+	if rc.pool != nil && *rc.pool != defaultPoolConfig {
+		s += fmt.Sprintf(" pool:{%s}", rc.pool)
+	}
+	if rc.hello {
+		s += " hello:true"
+	}
+	return s
+}
+
+// An environment returns the value of the plugin configuration key, or "" if it is not set.
+type environment func(key string) string
+
+// getRedisConfigFromEnv reads the connection settings with getRedisConfig and
+// all further options from the plugin configuration.
+func getRedisConfigFromEnv(env environment) (*redisConfig, error) {
+	rc, err := getRedisConfig(env("Hosts"), env("Password"), env("DB"), env("UseTLS"), env("TLSSkipVerify"), env("Key"))
+	if err != nil {
+		return nil, err
+	}
+
+	rc.username = env("Username")
+	rc.credentials, err = newCredentials(rc.username, rc.password, env("UsernameFile"), env("PasswordFile"))
+	if err != nil {
+		return nil, err
+	}
+	rc.clientName = env("ClientName")
+	hello := env("Hello")
+	if hello != "" {
+		rc.hello, err = strconv.ParseBool(hello)
+		if err != nil {
+			return nil, fmt.Errorf("hello must be a bool: %w", err)
+		}
+	}
+	if rc.credentials != nil {
+		rc.username, rc.password, _ = rc.credentials.get()
+	}
+	if rc.username != "" && rc.password == "" {
+		return nil, fmt.Errorf("username requires a password")
+	}
+	rc.pool, err = getPoolConfig(env("MaxIdle"), env("MaxActive"), env("IdleTimeout"), env("Wait"), env("ConnectTimeout"), env("ReadTimeout"), env("WriteTimeout"), env("TestOnBorrowInterval"))
+	if err != nil {
+		return nil, err
+	}
+
+	rc.tls, err = getTLSOptions(env("TLSCAFile"), env("TLSCertFile"), env("TLSKeyFile"), env("TLSServerName"), env("TLSMinVersion"), env("TLSPinSHA256"))
+	if err != nil {
+		return nil, err
+	}
+	if env("TLSSkipVerify") == "" && rc.tls.configured() {
+		// skipping the verification is the default for compatibility only
+		rc.tlsskipverify = false
+	}
+
+	for i := range rc.hosts {
+		h := &rc.hosts[i]
+		if !h.credentials {
+			h.username = rc.username
+			h.creds = rc.credentials
+		}
+		h.clientName = rc.clientName
+		h.hello = rc.hello
+		h.tlsskipverify = rc.tlsskipverify
+		h.tls = rc.tls
+		h.pool = rc.pool
+	}
+
+	rc.keyTemplate, err = newKeyTemplate(rc.key, env("KeyFallback"))
+	if err != nil {
+		return nil, err
+	}
+	rc.keyExpire, err = getKeyExpire(env("KeyExpire"))
+	if err != nil {
+		return nil, err
+	}
+
+	dataType := strings.ToLower(env("DataType"))
+	switch dataType {
+	case "", dataTypeList:
+		rc.dataType = dataTypeList
+	case dataTypeStream, dataTypeChannel:
+		rc.dataType = dataType
+	default:
+		return nil, fmt.Errorf("datatype must be one of %s, %s or %s but is:%s", dataTypeList, dataTypeStream, dataTypeChannel, dataType)
+	}
+
+	rc.list, err = getListConfig(env("MaxLength"), env("PushDirection"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.list != nil && rc.dataType != dataTypeList {
+		return nil, fmt.Errorf("maxlength and pushdirection can only be used with datatype %s", dataTypeList)
+	}
+
+	if rc.dataType == dataTypeStream {
+		stream, err := getStreamConfig(env("StreamMaxLen"), env("StreamMinID"), env("StreamTrimApprox"), env("StreamFields"))
+		if err != nil {
+			return nil, err
+		}
+		rc.stream = stream
+	}
+
+	if rc.dataType == dataTypeChannel {
+		noSubscribers, err := getNoSubscribers(env("ChannelNoSubscribers"))
+		if err != nil {
+			return nil, err
+		}
+		rc.noSubscribers = noSubscribers
+		if rc.keyExpire > 0 {
+			return nil, fmt.Errorf("keyexpire can not be used with datatype %s", dataTypeChannel)
+		}
+	}
+
+	rc.dedupWindow, err = getDedupWindow(env("DedupWindow"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.dedupWindow > 0 && rc.dataType == dataTypeChannel {
+		return nil, fmt.Errorf("dedupwindow can not be used with datatype %s", dataTypeChannel)
+	}
+
+	rc.batch, err = getBatchConfig(env("BatchSize"), env("BatchBytes"))
+	if err != nil {
+		return nil, err
+	}
+
+	rc.script, err = getScriptConfig(env("Script"), env("ScriptFile"), env("Function"), env("ScriptCall"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.script != nil {
+		switch {
+		case rc.dataType == dataTypeChannel:
+			return nil, fmt.Errorf("script and function can not be used with datatype %s", dataTypeChannel)
+		case rc.list != nil:
+			return nil, fmt.Errorf("maxlength and pushdirection can not be used with script or function")
+		case rc.dedupWindow > 0:
+			return nil, fmt.Errorf("dedupwindow can not be used with script or function")
+		}
+	}
+
+	rc.watermarks, err = getWatermarks(env("HighWatermark"), env("LowWatermark"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.watermarks != nil && rc.dataType == dataTypeChannel {
+		return nil, fmt.Errorf("highwatermark can not be used with datatype %s", dataTypeChannel)
+	}
+
+	cluster := env("Cluster")
+	if cluster != "" {
+		rc.cluster, err = strconv.ParseBool(cluster)
+		if err != nil {
+			return nil, fmt.Errorf("cluster must be a bool: %w", err)
+		}
+	}
+	transactional := env("Transactional")
+	if transactional != "" {
+		rc.transactional, err = strconv.ParseBool(transactional)
+		if err != nil {
+			return nil, fmt.Errorf("transactional must be a bool: %w", err)
+		}
+	}
+	if rc.cluster {
+		if rc.transactional {
+			return nil, fmt.Errorf("transactional can not be used in cluster mode")
+		}
+		if rc.script != nil && rc.script.function == "" {
+			return nil, fmt.Errorf("script can not be used in cluster mode, use function instead")
+		}
+		if rc.db != 0 {
+			return nil, fmt.Errorf("db must be 0 in cluster mode but is:%d", rc.db)
+		}
+		if rc.dataType == dataTypeChannel {
+			return nil, fmt.Errorf("datatype %s is not supported in cluster mode", dataTypeChannel)
+		}
+		for _, host := range rc.hosts {
+			if host.socket != "" {
+				return nil, fmt.Errorf("unix sockets can not be used in cluster mode")
+			}
+			if host.scheme != "" {
+				return nil, fmt.Errorf("urls can not be used in cluster mode")
+			}
+		}
+	}
+
+	rc.health, err = getHealthConfig(env("EjectAfterFailures"), env("EjectBackoff"), env("EjectMaxBackoff"), env("HealthCheckInterval"))
+	if err != nil {
+		return nil, err
+	}
+
+	rc.sentinelHosts, err = getSentinelHosts(env("SentinelHosts"))
+	if err != nil {
+		return nil, err
+	}
+	rc.sentinelMaster = env("SentinelMaster")
+	rc.sentinelPassword = env("SentinelPassword")
+	if len(rc.sentinelHosts) > 0 {
+		if rc.sentinelMaster == "" {
+			return nil, fmt.Errorf("sentinelmaster is required with sentinelhosts")
+		}
+		if rc.cluster {
+			return nil, fmt.Errorf("sentinelhosts can not be used in cluster mode")
+		}
+	}
+
+	rc.writeMode, err = getWriteMode(env("WriteMode"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.writeMode.replicated() {
+		if rc.cluster {
+			return nil, fmt.Errorf("writemode %s can not be used in cluster mode", rc.writeMode)
+		}
+		if len(rc.sentinelHosts) > 0 {
+			return nil, fmt.Errorf("writemode %s can not be used with sentinelhosts", rc.writeMode)
+		}
+		if required := rc.writeMode.required(len(rc.hosts)); required > len(rc.hosts) {
+			return nil, fmt.Errorf("writemode %s requires %d hosts but only %d are configured", rc.writeMode, required, len(rc.hosts))
+		}
+	}
+
+	rc.shardBy = env("ShardBy")
+	rc.shardTemplate, err = getShardBy(rc.shardBy, env("KeyFallback"))
+	if err != nil {
+		return nil, fmt.Errorf("shardby is invalid: %w", err)
+	}
+	if rc.shardBy != "" {
+		switch {
+		case rc.cluster:
+			return nil, fmt.Errorf("shardby can not be used in cluster mode")
+		case len(rc.sentinelHosts) > 0:
+			return nil, fmt.Errorf("shardby can not be used with sentinelhosts")
+		case rc.writeMode.replicated():
+			return nil, fmt.Errorf("shardby can not be used with writemode %s", rc.writeMode)
+		}
+	}
+
+	rc.loadBalancing, err = getLoadBalancing(env("LoadBalancing"))
+	if err != nil {
+		return nil, err
+	}
+	if rc.loadBalancing != loadBalancingRandom {
+		switch {
+		case rc.cluster:
+			return nil, fmt.Errorf("loadbalancing can not be used in cluster mode")
+		case len(rc.sentinelHosts) > 0:
+			return nil, fmt.Errorf("loadbalancing can not be used with sentinelhosts")
+		case rc.shardBy != "":
+			return nil, fmt.Errorf("loadbalancing can not be used with shardby")
+		}
+	}
+
+	// the spool locks its directory, so it is opened after all checks
+	rc.spool, err = openSpool(env("SpoolDir"), env("SpoolMaxSize"), env("SpoolReplayInterval"))
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
 }
 
 func getRedisConfig(hosts, password, db, usetls, tlsskipverify, key string) (*redisConfig, error) {
@@ -70,31 +543,6 @@ func getRedisConfig(hosts, password, db, usetls, tlsskipverify, key string) (*re
 		key = "logstash"
 	}
 
-	hostAndPorts := strings.Split(hosts, " ")
-	for _, hostAndPort := range hostAndPorts {
-		rh := redisHost{}
-		if strings.Contains(hostAndPort, ":") {
-			hostAndPortArray := strings.Split(hostAndPort, ":")
-			if len(hostAndPortArray) != 2 {
-				return nil, fmt.Errorf("hosts must be in the form host:port but is:%s", hostAndPort)
-			}
-
-			port, err := strconv.Atoi(hostAndPortArray[1])
-			if err != nil {
-				return nil, fmt.Errorf("port must be numeric:%w", err)
-			}
-			if port < 0 || port > 65535 {
-				return nil, fmt.Errorf("port must between 0-65535 not:%d", port)
-			}
-			rh.hostname = hostAndPortArray[0]
-			rh.port = port
-		} else {
-			rh.hostname = hostAndPort
-			rh.port = 6379
-		}
-		rc.hosts = append(rc.hosts, rh)
-	}
-
 	dbValue, err := strconv.Atoi(db)
 	if db != "" && err != nil {
 		return nil, fmt.Errorf("db must be a integer: %w", err)
@@ -113,25 +561,118 @@ func getRedisConfig(hosts, password, db, usetls, tlsskipverify, key string) (*re
 	}
 	rc.tlsskipverify = tlsverify
 	rc.password = password
+
+	// the global settings are the defaults of every host
+	defaults := redisHost{password: rc.password, db: rc.db, usetls: rc.usetls, tlsskipverify: rc.tlsskipverify}
+	hostAndPorts := strings.Split(hosts, " ")
+	for _, hostAndPort := range hostAndPorts {
+		var (
+			rh  redisHost
+			err error
+		)
+		if isRedisURL(hostAndPort) {
+			rh, err = getRedisURL(hostAndPort, defaults)
+		} else {
+			rh, err = getRedisHost(hostAndPort)
+			rh.password, rh.db, rh.usetls, rh.tlsskipverify = defaults.password, defaults.db, defaults.usetls, defaults.tlsskipverify
+		}
+		if err != nil {
+			return nil, err
+		}
+		rc.hosts = append(rc.hosts, rh)
+	}
+
 	rc.key = key
+	rc.dataType = dataTypeList
+	rc.loadBalancing = loadBalancingRandom
 
 	return rc, nil
 }
 
+// getRedisHost parses host:port, [ipv6]:port or unix:///path/to/socket, the
+// port defaults to 6379.
+func getRedisHost(hostAndPort string) (redisHost, error) {
+	rh := redisHost{}
+	if strings.HasPrefix(hostAndPort, unixScheme) {
+		rh.socket = strings.TrimPrefix(hostAndPort, unixScheme)
+		if !strings.HasPrefix(rh.socket, "/") {
+			return rh, fmt.Errorf("unix socket must be an absolute path but is:%s", hostAndPort)
+		}
+		return rh, nil
+	}
+
+	host, p := hostAndPort, ""
+	switch {
+	case strings.HasPrefix(hostAndPort, "["):
+		if strings.HasSuffix(hostAndPort, "]") {
+			host = hostAndPort[1 : len(hostAndPort)-1]
+		} else {
+			var err error
+			host, p, err = net.SplitHostPort(hostAndPort)
+			if err != nil {
+				return rh, fmt.Errorf("hosts must be in the form [ipv6]:port but is:%s", hostAndPort)
+			}
+		}
+		if net.ParseIP(host) == nil {
+			return rh, fmt.Errorf("hosts must be in the form [ipv6]:port but is:%s", hostAndPort)
+		}
+	case strings.Contains(hostAndPort, ":"):
+		hostAndPortArray := strings.Split(hostAndPort, ":")
+		if len(hostAndPortArray) != 2 {
+			return rh, fmt.Errorf("hosts must be in the form host:port but is:%s", hostAndPort)
+		}
+		host, p = hostAndPortArray[0], hostAndPortArray[1]
+	}
+
+	rh.hostname = host
+	rh.port = 6379
+	if p == "" {
+		return rh, nil
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return rh, fmt.Errorf("port must be numeric:%w", err)
+	}
+	if port < 0 || port > 65535 {
+		return rh, fmt.Errorf("port must between 0-65535 not:%d", port)
+	}
+	rh.port = port
+	return rh, nil
+}
+
 func (rp *redisPools) getRedisPoolFromPools() (*redis.Pool, error) {
-	// FIXME check for equally used active connections, and if Pool is active and healthy
+	next, err := rp.next()
+	if err != nil {
+		return nil, err
+	}
+	return rp.pools[next], nil
+}
+
+// next returns the index of the pool to use.
+func (rp *redisPools) next() (int, error) {
 	if len(rp.pools) == 0 {
-		return nil, fmt.Errorf("pool is empty")
+		return 0, fmt.Errorf("pool is empty")
 	}
-	next := rand.Intn(len(rp.pools)) // nolint:gosec
-	pool := rp.pools[next]
-	if pool == nil {
-		return nil, fmt.Errorf("pool is nil in pools")
+	candidates := rp.candidates()
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("pool is nil in pools")
 	}
-	return pool, nil
+	return candidates[0], nil
+}
+
+// host returns the address of the pool at index i.
+func (rp *redisPools) host(i int) string {
+	if i < len(rp.hosts) {
+		return rp.hosts[i]
+	}
+	return ""
 }
 
 func (rp *redisPools) closeAll() {
+	if rp.done != nil {
+		close(rp.done)
+		rp.wg.Wait()
+	}
 	for _, pool := range rp.pools {
 		pool.Close()
 	}
@@ -139,70 +680,317 @@ func (rp *redisPools) closeAll() {
 
 func newPoolsFromConfig(rc *redisConfig) *redisPools {
 	pools := make([]*redis.Pool, len(rc.hosts))
+	hosts := make([]string, len(rc.hosts))
+	health := make([]*poolHealth, len(rc.hosts))
 	i := 0
 	for _, host := range rc.hosts {
-		pool := newPool(host.hostname, host.port, rc.db, rc.password, rc.usetls, rc.tlsskipverify)
+		pool := newHostPool(host)
 		pools[i] = pool
+		hosts[i] = host.address()
+		health[i] = &poolHealth{}
 		i++
 	}
 	return &redisPools{
-		pools: pools,
+		pools:        pools,
+		hosts:        hosts,
+		health:       health,
+		healthConfig: rc.health,
+		balancer:     newBalancer(rc.loadBalancing, pools),
+	}
+}
+
+// nodeHost returns a host with the global settings, for nodes which are
+// discovered by the cluster or the sentinels.
+func (rc *redisConfig) nodeHost(hostname string, port int) redisHost {
+	return redisHost{
+		hostname:      hostname,
+		port:          port,
+		username:      rc.username,
+		password:      rc.password,
+		db:            rc.db,
+		usetls:        rc.usetls,
+		tlsskipverify: rc.tlsskipverify,
+		clientName:    rc.clientName,
+		hello:         rc.hello,
+		creds:         rc.credentials,
+		tls:           rc.tls,
+		pool:          rc.pool,
 	}
 }
 
 func newPool(host string, port int, db int, password string, usetls, tlsskipverify bool) *redis.Pool {
-	server := fmt.Sprintf("%s:%d", host, port)
-	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server, redis.DialDatabase(db),
-				redis.DialUseTLS(usetls),
-				redis.DialTLSSkipVerify(tlsskipverify),
-			)
-			if err != nil {
-				return nil, err
-			}
-			// In case redis needs authentication
-			if password != "" {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if time.Since(t) < time.Minute {
-				return nil
+	return newHostPool(redisHost{hostname: host, port: port, db: db, password: password, usetls: usetls, tlsskipverify: tlsskipverify})
+}
+
+func (r *redisClient) send(values []*logmessage) error {
+	if r.cluster != nil {
+		return r.sendCluster(values)
+	}
+	if r.sentinel != nil {
+		pool, host, err := r.sentinel.getPool()
+		if err != nil {
+			// no master is known, like a host which is down
+			return &sendError{record: -1, err: err}
+		}
+		err = r.sendTo(pool, host, values)
+		if hasReply(err, "READONLY") {
+			// the master was demoted, the next flush is sent to the new one
+			if rerr := r.sentinel.resolve(); rerr != nil {
+				fmt.Printf("%v\n", rerr)
 			}
-			_, err := c.Do("PING")
+		}
+		return err
+	}
+	if r.writeMode.replicated() {
+		return r.sendReplicated(values)
+	}
+	if r.shardBy != nil {
+		return r.sendSharded(values)
+	}
+
+	// try the next healthy host if a host fails
+	var lastErr error
+	candidates := r.pools.candidates()
+	if len(candidates) == 0 {
+		return fmt.Errorf("pool is empty")
+	}
+	for _, i := range candidates {
+		err := r.sendTo(r.pools.pools[i], r.pools.host(i), values)
+		if err == nil {
+			r.pools.success(i)
+			return nil
+		}
+		if errors.Is(err, errNoSubscribers) {
+			// the logs are published, another host would publish them again
+			r.pools.success(i)
+			return err
+		}
+		var se *sendError
+		if !errors.As(err, &se) || se.permanent {
+			// the host is not to blame
 			return err
-		},
+		}
+		if blamesHost(err) {
+			r.pools.failure(i, err)
+		}
+		lastErr = err
+		fmt.Printf("%v\n", err)
 	}
+	return lastErr
 }
 
-func (r *redisClient) send(values []*logmessage) error {
-	pool, err := r.pools.getRedisPoolFromPools()
+func (r *redisClient) sendTo(pool *redis.Pool, host string, values []*logmessage) error {
+	conn := pool.Get()
+	defer conn.Close()
+	return withHost(r.sendImpl(&redisConn{conn}, host, values), host)
+}
+
+func (r *redisClient) sendImpl(rd asyncConnection, host string, values []*logmessage) error {
+	batches := r.key.groupByKey(values)
+	err := r.checkBackpressure(rd, host, batches)
 	if err != nil {
 		return err
 	}
-	conn := pool.Get()
-	defer conn.Close()
+	cmds := r.commands(batches)
+	err = r.write(rd, cmds)
+	if err != nil {
+		return err
+	}
+	r.report(cmds)
+	if r.dataType == dataTypeChannel {
+		return r.reportPublished(batches)
+	}
+	return nil
+}
 
-	return r.sendImpl(&redisConn{conn}, values)
+// pipeline sends all commands and reads their replies.
+func pipeline(rd asyncConnection, cmds []*command) error {
+	errs, err := roundTrip(rd, cmds)
+	if err != nil {
+		return err
+	}
+	return classify(cmds, errs)
 }
 
-func (r *redisClient) sendImpl(rd asyncConnection, values []*logmessage) error {
-	for _, v := range values {
-		err := rd.Send("RPUSH", r.key, v.data)
+// roundTrip sends all commands in a pipeline, errs holds the error redis
+// replied to each command.
+func roundTrip(rd asyncConnection, cmds []*command) ([]error, error) {
+	for _, c := range cmds {
+		err := rd.Send(c.name, c.args...)
 		if err != nil {
-			v := string(v.data)
-			if len(v) > 15 {
-				v = v[0:12] + "..."
+			return nil, c.connError(err)
+		}
+	}
+	err := rd.Flush()
+	if err != nil {
+		return nil, &sendError{record: -1, err: err}
+	}
+	return replies(rd, cmds)
+}
+
+func (r *redisClient) sendCluster(values []*logmessage) error {
+	batches := r.key.groupByKey(values)
+	if r.backpressure != nil {
+		lengths := r.backpressure.commands(batches)
+		if err := r.cluster.send(lengths); err != nil {
+			return err
+		}
+		if err := r.backpressure.verify("", lengths); err != nil {
+			return err
+		}
+	}
+	cmds := r.commands(batches)
+	err := r.cluster.send(cmds)
+	if err != nil {
+		return err
+	}
+	r.report(cmds)
+	return nil
+}
+
+func (r *redisClient) close() {
+	if r.spool != nil {
+		r.spool.close()
+	}
+	r.writes.Wait()
+	if r.pools != nil {
+		r.pools.closeAll()
+	}
+	if r.cluster != nil {
+		r.cluster.close()
+	}
+	if r.sentinel != nil {
+		r.sentinel.close()
+	}
+	if r.credentials != nil {
+		r.credentials.close()
+	}
+}
+
+// report logs the evicted and skipped records of a successful flush.
+func (r *redisClient) report(cmds []*command) {
+	r.list.reportEvicted(cmds)
+	r.dedup.reportSkipped(cmds)
+}
+
+// A command is a redis command which is sent in a pipeline.
+type command struct {
+	name string
+	key  string
+	args []interface{}
+	// v is the message stored by the command, nil for other commands
+	v *logmessage
+	// index is the position of v in the flush, -1 for other commands
+	index int
+	// records is the number of records written by a variadic command, v is
+	// the first of them
+	records int
+	// wrapped is the command executed by the dedup script, "" if the
+	// command is sent as is
+	wrapped string
+	// length is the reply of LLEN, XLEN, RPUSH and LPUSH
+	length int64
+	// duplicate is 1 if the dedup script skipped v
+	duplicate int32
+}
+
+// op returns the command which is executed by redis.
+func (c *command) op() string {
+	if c.wrapped != "" {
+		return c.wrapped
+	}
+	return c.name
+}
+
+// reply processes the successful reply of the command.
+func (c *command) reply(reply interface{}) {
+	if c.wrapped != "" && reply == nil {
+		// the commands may be sent to several hosts
+		atomic.StoreInt32(&c.duplicate, 1)
+		return
+	}
+	if c.name == "PUBLISH" && c.v != nil {
+		// the message may be published to several hosts
+		n, _ := redis.Int64(reply, nil)
+		atomic.AddInt64(&c.v.receivers, n)
+	}
+	switch c.op() {
+	case "LLEN", "XLEN", "RPUSH", "LPUSH":
+		// the commands may be sent to several hosts
+		n, _ := redis.Int64(reply, nil)
+		atomic.StoreInt64(&c.length, n)
+	}
+}
+
+// fail classifies an error replied to the command.
+func (c *command) fail(err error) *sendError {
+	return &sendError{record: c.index, permanent: isPermanentReply(err), err: denied(c.error(err))}
+}
+
+// connError classifies an error of the connection while the command was sent.
+// The connection is dialed lazily, an AUTH, HELLO or SELECT which is denied by
+// the acl is permanent.
+func (c *command) connError(err error) *sendError {
+	return &sendError{record: c.index, permanent: hasReply(err, "NOPERM"), err: denied(c.error(err))}
+}
+
+func (c *command) error(err error) error {
+	if c.v == nil {
+		return fmt.Errorf("error sending %s to key %s: %w", c.name, c.key, err)
+	}
+	v := string(c.v.data)
+	if len(v) > 15 {
+		v = v[0:12] + "..."
+	}
+	if c.name == "PUBLISH" {
+		return fmt.Errorf("error publishing %s to channel %s: %w", v, c.key, err)
+	}
+	if c.records > 1 {
+		return fmt.Errorf("error setting key %s to %s and %d more records: %w", c.key, v, c.records-1, err)
+	}
+	return fmt.Errorf("error setting key %s to %s: %w", c.key, v, err)
+}
+
+// commands returns the commands which store all batches.
+func (r *redisClient) commands(batches []*keyBatch) []*command {
+	var cmds []*command
+	for _, b := range batches {
+		if r.script.batched() {
+			// the script writes the records of the key at once
+			cmds = append(cmds, r.scriptCommands(b)...)
+		} else if r.variadic() {
+			cmds = append(cmds, r.pushCommands(b)...)
+		} else {
+			for i, v := range b.values {
+				name, args := r.command(b.key, v)
+				cmd := &command{name: name, key: b.key, args: args, v: v, index: b.indexes[i]}
+				if r.dedup != nil {
+					cmd.wrapped = name
+					cmd.name, cmd.args = r.dedup.wrap(b.key, v, name, args)
+				}
+				cmds = append(cmds, cmd)
 			}
-			return fmt.Errorf("error setting key %s to %s: %w", r.key, v, err)
 		}
+		if r.list.capped() {
+			cmds = append(cmds, &command{name: "LTRIM", key: b.key, args: r.list.ltrimArgs(b.key), index: -1})
+		}
+		if r.expiry != nil {
+			cmds = append(cmds, &command{name: "EXPIRE", key: b.key, args: r.expiry.expireArgs(b.key), index: -1})
+		}
+	}
+	return cmds
+}
+
+// command returns the redis command and its arguments which stores the message at key.
+func (r *redisClient) command(key string, v *logmessage) (string, []interface{}) {
+	if r.script != nil {
+		return r.script.command(key, v)
+	}
+	switch r.dataType {
+	case dataTypeStream:
+		return "XADD", r.stream.xaddArgs(key, v)
+	case dataTypeChannel:
+		return "PUBLISH", []interface{}{key, v.data}
 	}
-	return rd.Flush()
+	return r.list.push(), []interface{}{key, v.data}
 }
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// A mapEnvironment is used as plugin configuration in tests.
+type mapEnvironment map[string]string
+
+func (m mapEnvironment) get(key string) string {
+	return m[key]
+}
+
 func TestGetRedisConfig(t *testing.T) {
 	// test for defaults
 	c, err := getRedisConfig("", "", "", "", "", "")
@@ -22,7 +36,7 @@ func TestGetRedisConfig(t *testing.T) {
 	assert.Equal(t, 1, len(c.hosts), "it is expected to have one host by default")
 	assert.Equal(t, "127.0.0.1", c.hosts[0].hostname, "it is expected to have 127.0.0.1 as host by default")
 	assert.Equal(t, 6379, c.hosts[0].port, "it is expected to have 6379 as port by default")
-	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash", c.String())
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list", c.String())
 
 	// valid configuration parameter passed
 	c, err = getRedisConfig("", "geheim", "1", "true", "false", "elastic")
@@ -64,7 +78,7 @@ func TestGetRedisConfig(t *testing.T) {
 
 	assert.Equal(t, "1.2.3.5", c.hosts[1].hostname, "it is expected to have 1.2.3.5")
 	assert.Equal(t, 6379, c.hosts[1].port, "it is expected to have 6379")
-	assert.Equal(t, "hosts:[{1.2.3.4 42} {1.2.3.5 6379}] db:0 usetls:false tlsskipverify:true key:logstash", c.String())
+	assert.Equal(t, "hosts:[{1.2.3.4 42} {1.2.3.5 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list", c.String())
 
 	// invalid configurations
 	_, err = getRedisConfig("", "", "A", "", "", "")
@@ -160,6 +174,10 @@ func (r *testConnection) Flush() error {
 	return nil
 }
 
+func (r *testConnection) Receive() (interface{}, error) {
+	return nil, nil
+}
+
 func TestRedisSendMessage(t *testing.T) {
 	rc := &redisClient{}
 	values := []*logmessage{
@@ -167,7 +185,7 @@ func TestRedisSendMessage(t *testing.T) {
 		&logmessage{data: []byte("test2")},
 	}
 	conn := &testConnection{}
-	err := rc.sendImpl(conn, values)
+	err := rc.sendImpl(conn, "", values)
 	assert.NoError(t, err, "send should be ok")
 	assert.Equal(t, len(values), len(conn.invokes), "every messages should be sended")
 	assert.True(t, conn.flushed, "data should be flushed")
@@ -181,7 +199,159 @@ func TestRedisSendFailureMessage(t *testing.T) {
 		&logmessage{data: []byte("test2")},
 	}
 	conn := &testConnection{fail: "failure"}
-	err := rc.sendImpl(conn, values)
+	err := rc.sendImpl(conn, "", values)
 	assert.Error(t, err, "send should not be ok")
 	assert.False(t, conn.flushed, "data should not be flushed")
 }
+
+func TestGetRedisHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    redisHost
+		network string
+		address string
+		err     string
+	}{
+		{host: "1.2.3.4", want: redisHost{hostname: "1.2.3.4", port: 6379}, network: "tcp", address: "1.2.3.4:6379"},
+		{host: "[2001:db8::1]:6380", want: redisHost{hostname: "2001:db8::1", port: 6380}, network: "tcp", address: "[2001:db8::1]:6380"},
+		{host: "[::1]", want: redisHost{hostname: "::1", port: 6379}, network: "tcp", address: "[::1]:6379"},
+		{host: "unix:///var/run/redis.sock", want: redisHost{socket: "/var/run/redis.sock"}, network: "unix", address: "/var/run/redis.sock"},
+		{host: "unix://redis.sock", err: "unix socket must be an absolute path but is:unix://redis.sock"},
+		{host: "[2001:db8::1]:port", err: "port must be numeric:strconv.Atoi: parsing \"port\": invalid syntax"},
+		{host: "[2001:db8::1]6379", err: "hosts must be in the form [ipv6]:port but is:[2001:db8::1]6379"},
+		{host: "[ahost]:6379", err: "hosts must be in the form [ipv6]:port but is:[ahost]:6379"},
+		{host: "2001:db8::1", err: "hosts must be in the form host:port but is:2001:db8::1"},
+	}
+	for _, tt := range tests {
+		h, err := getRedisHost(tt.host)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err, tt.host)
+			continue
+		}
+		require.NoError(t, err, tt.host)
+		assert.Equal(t, tt.want, h, tt.host)
+		assert.Equal(t, tt.network, h.network(), tt.host)
+		assert.Equal(t, tt.address, h.address(), tt.host)
+	}
+
+	c, err := getRedisConfig("[2001:db8::1]:6380 unix:///var/run/redis.sock", "", "", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{2001:db8::1 6380} {unix:///var/run/redis.sock}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list", c.String())
+	assert.Equal(t, []string{"[2001:db8::1]:6380", "/var/run/redis.sock"}, newPoolsFromConfig(c).hosts)
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Hosts": "unix:///var/run/redis.sock", "Cluster": "true"}.get)
+	assert.EqualError(t, err, "unix sockets can not be used in cluster mode")
+}
+
+// A fakeRedisServer records the commands of all connections and answers them
+// with +OK, PING with +PONG.
+type fakeRedisServer struct {
+	mu       sync.Mutex
+	commands [][]string
+	// errors are replied to the commands instead of +OK
+	errors map[string]string
+	// password is required by AUTH if set
+	password string
+	// discard does not record the commands, e.g. in benchmarks
+	discard bool
+}
+
+func serveFakeRedis(t testing.TB, l net.Listener) *fakeRedisServer {
+	s := &fakeRedisServer{}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedisServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+		if err != nil {
+			return
+		}
+		var cmd []string
+		for i := 0; i < n; i++ {
+			// skip the length of the bulk string
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd = append(cmd, strings.TrimSpace(arg))
+		}
+		s.mu.Lock()
+		if !s.discard {
+			s.commands = append(s.commands, cmd)
+		}
+		reply, failed := s.errors[cmd[0]]
+		if cmd[0] == "AUTH" && s.password != "" && cmd[len(cmd)-1] != s.password {
+			reply, failed = "WRONGPASS invalid username-password pair or user is disabled.", true
+		}
+		s.mu.Unlock()
+		if failed {
+			fmt.Fprintf(c, "-%s\r\n", reply)
+			continue
+		}
+		if cmd[0] == "PING" {
+			fmt.Fprint(c, "+PONG\r\n")
+			continue
+		}
+		fmt.Fprint(c, "+OK\r\n")
+	}
+}
+
+func (s *fakeRedisServer) requirePass(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// fail replies the error to cmd, an empty reply lets cmd succeed again.
+func (s *fakeRedisServer) fail(cmd, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errors == nil {
+		s.errors = make(map[string]string)
+	}
+	if reply == "" {
+		delete(s.errors, cmd)
+		return
+	}
+	s.errors[cmd] = reply
+}
+
+func (s *fakeRedisServer) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string{}, s.commands...)
+}
+
+func TestUnixSocketPool(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "redis.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := serveFakeRedis(t, l)
+
+	h, err := getRedisHost("unix://" + socket)
+	require.NoError(t, err)
+	pool := newHostPool(h)
+	defer pool.Close()
+	assert.NoError(t, ping(pool), "the pool should dial the unix socket")
+	assert.Equal(t, [][]string{{"PING"}}, server.received())
+}
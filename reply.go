@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// permanentReplies are the prefixes of redis errors which fail again with the
+// same records: the data does not fit the key, the command is malformed or the
+// user is not allowed to run it. All other errors replied by redis, e.g.
+// MISCONF or "ERR max number of clients reached", are retried.
+var permanentReplies = []string{
+	"WRONGTYPE ",
+	"NOPERM ",
+	"NOAUTH ",
+	"WRONGPASS ",
+	"EXECABORT ",
+	"ERR wrong number of arguments",
+	"ERR syntax error",
+	"ERR unknown command",
+	"ERR value is not",
+	"ERR Invalid stream ID",
+	"ERR The ID specified in XADD",
+}
+
+// retryableReplies are the prefixes of redis errors which are known to
+// succeed later, they are never permanent.
+var retryableReplies = []string{
+	"OOM",
+	"READONLY",
+	"LOADING",
+	"BUSY",
+	"MASTERDOWN",
+	"MISCONF",
+	"TRYAGAIN",
+	"CLUSTERDOWN",
+	"NOREPLICAS",
+	"NOSCRIPT",
+	"MOVED",
+	"ASK",
+}
+
+// A sendError is returned if a host failed or redis rejected a command.
+type sendError struct {
+	host string
+	// record is the position of the record in the flush, -1 if the error was
+	// not caused by a record.
+	record    int
+	permanent bool
+	err       error
+}
+
+func (e *sendError) Error() string {
+	var sb strings.Builder
+	if e.host != "" {
+		fmt.Fprintf(&sb, "host %s: ", e.host)
+	}
+	if e.record >= 0 {
+		fmt.Fprintf(&sb, "record %d: ", e.record)
+	}
+	sb.WriteString(e.err.Error())
+	return sb.String()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// isPermanent returns true if sending again will fail again.
+func isPermanent(err error) bool {
+	var se *sendError
+	return errors.As(err, &se) && se.permanent
+}
+
+// isPermanentReply returns true if err is a redis error which fails again if
+// it is retried.
+func isPermanentReply(err error) bool {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		// network errors and timeouts
+		return false
+	}
+	for _, prefix := range retryableReplies {
+		if strings.HasPrefix(rerr.Error(), prefix+" ") {
+			return false
+		}
+	}
+	for _, prefix := range permanentReplies {
+		if strings.HasPrefix(rerr.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasReply returns true if err contains a redis error with the given prefix.
+func hasReply(err error, prefix string) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr) && strings.HasPrefix(rerr.Error(), prefix+" ")
+}
+
+// denied explains an error if the acl of the redis user does not allow a command or key.
+func denied(err error) error {
+	if hasReply(err, "NOPERM") {
+		return fmt.Errorf("permission denied by the acl of the redis user: %w", err)
+	}
+	return err
+}
+
+// withHost adds the host to a sendError, other errors are wrapped in a retryable sendError.
+func withHost(err error, host string) error {
+	if err == nil {
+		return nil
+	}
+	var se *sendError
+	if errors.As(err, &se) {
+		se.host = host
+		return err
+	}
+	return &sendError{host: host, record: -1, err: err}
+}
+
+// replies reads the replies of all commands, errs holds the error redis
+// replied to each command. An error is returned if the connection broke.
+func replies(rd asyncConnection, cmds []*command) ([]error, error) {
+	errs := make([]error, len(cmds))
+	for i, c := range cmds {
+		reply, err := rd.Receive()
+		if err == nil {
+			c.reply(reply)
+			continue
+		}
+		var rerr redis.Error
+		if !errors.As(err, &rerr) {
+			// the connection is broken, the remaining replies can not be read
+			return nil, &sendError{record: c.index, err: c.error(err)}
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
+
+// classify returns the first error replied to the commands. It is only
+// permanent if all errors are permanent.
+func classify(cmds []*command, errs []error) error {
+	var firstErr *sendError
+	permanent := true
+	for i, c := range cmds {
+		if errs[i] == nil {
+			continue
+		}
+		se := c.fail(errs[i])
+		permanent = permanent && se.permanent
+		if firstErr == nil {
+			firstErr = se
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+	firstErr.permanent = permanent
+	return firstErr
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermanentReply(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{err: redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), permanent: true},
+		{err: redis.Error("NOAUTH Authentication required."), permanent: true},
+		{err: redis.Error("NOPERM this user has no permissions to run the 'rpush' command"), permanent: true},
+		{err: redis.Error("ERR wrong number of arguments for 'rpush' command"), permanent: true},
+		{err: redis.Error("OOM command not allowed when used memory > 'maxmemory'."), permanent: false},
+		{err: redis.Error("READONLY You can't write against a read only replica."), permanent: false},
+		{err: redis.Error("LOADING Redis is loading the dataset in memory"), permanent: false},
+		{err: redis.Error("BUSY Redis is busy running a script."), permanent: false},
+		{err: redis.Error("CLUSTERDOWN The cluster is down"), permanent: false},
+		{err: redis.Error("MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk."), permanent: false},
+		{err: redis.Error("ERR max number of clients reached"), permanent: false},
+		{err: redis.Error("ERR syntax error"), permanent: true},
+		{err: redis.Error("EXECABORT Transaction discarded because of previous errors."), permanent: true},
+		{err: redis.Error("ERR The ID specified in XADD is equal or smaller than the target stream top item"), permanent: true},
+		{err: redis.Error("UNKNOWNERROR something new"), permanent: false},
+		{err: io.EOF, permanent: false},
+		{err: fmt.Errorf("dial tcp: i/o timeout"), permanent: false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.permanent, isPermanentReply(tt.err), tt.err.Error())
+	}
+}
+
+func TestSendError(t *testing.T) {
+	err := withHost(&sendError{record: 3, err: fmt.Errorf("error setting key a to b: %w", redis.Error("WRONGTYPE wrong kind"))}, "hosta:6379")
+	assert.EqualError(t, err, "host hosta:6379: record 3: error setting key a to b: WRONGTYPE wrong kind")
+	assert.True(t, hasReply(err, "WRONGTYPE"), "the redis error should be unwrapped")
+
+	err = withHost(io.EOF, "hosta:6379")
+	assert.EqualError(t, err, "host hosta:6379: EOF")
+	assert.False(t, isPermanent(err), "network errors should be retried")
+	assert.True(t, errors.Is(err, io.EOF), "the cause should be unwrapped")
+
+	assert.NoError(t, withHost(nil, "hosta:6379"))
+	assert.False(t, isPermanent(fmt.Errorf("any error")), "errors are retried by default")
+}
+
+func TestRedisSendReplyErrors(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logs")}
+	values := []*logmessage{
+		{data: []byte("test1")},
+		{data: []byte("test2")},
+		{data: []byte("test3")},
+	}
+
+	conn := &recordingConnection{replies: []interface{}{int64(1), redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), int64(2)}}
+	err := rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 1: error setting key logs to test2: WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.True(t, isPermanent(err), "a wrong type should not be retried")
+	assert.Empty(t, conn.replies, "all replies should be drained")
+
+	conn = &recordingConnection{replies: []interface{}{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), redis.Error("OOM command not allowed"), int64(2)}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 0: error setting key logs to test1: WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.False(t, isPermanent(err), "the flush should be retried if one error is retryable")
+
+	conn = &recordingConnection{replies: []interface{}{int64(1), io.EOF}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 1: error setting key logs to test2: EOF")
+	assert.False(t, isPermanent(err), "a broken connection should be retried")
+}
+
+func TestClusterSendReplyErrors(t *testing.T) {
+	fc := newFakeCluster()
+	c := newTestCluster(fc)
+	rc := &redisClient{key: mustKeyTemplate(t, "${tag}"), cluster: c}
+	c.conn = func(addr string) (redis.Conn, error) {
+		return &errorConn{fakeClusterConn: fakeClusterConn{cluster: fc, addr: addr}, reply: redis.Error("NOAUTH Authentication required.")}, nil
+	}
+	err := rc.send([]*logmessage{{data: []byte("1"), tag: "foo"}})
+	assert.EqualError(t, err, "host 10.0.0.2:7000: record 0: error setting key foo to 1: NOAUTH Authentication required.")
+	assert.True(t, isPermanent(err), "a missing authentication should not be retried")
+}
+
+// An errorConn replies an error to every command of a fakeClusterConn.
+type errorConn struct {
+	fakeClusterConn
+	reply error
+}
+
+func (c *errorConn) Receive() (interface{}, error) {
+	return nil, c.reply
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	scriptCallRecord = "record"
+	scriptCallBatch  = "batch"
+)
+
+// A scriptConfig replaces the write command with a lua script, which is
+// called with EVALSHA, or with a redis function, which is called with FCALL.
+//
+// The key is passed as KEYS[1]. Per record, ARGV[1] is the json of the
+// record and ARGV[2] its tag. Per batch, ARGV holds the json of all records
+// of the flush which are written to the key.
+type scriptConfig struct {
+	// source of the script, "" if a function is called
+	source string
+	// sha is the sha1 of the source which is used by EVALSHA
+	sha string
+	// file the source was read from
+	file string
+	// function is the name of the redis function
+	function string
+	// call is either scriptCallRecord or scriptCallBatch
+	call string
+}
+
+func (sc *scriptConfig) String() string {
+	if sc.function != "" {
+		return fmt.Sprintf("function:%s call:%s", sc.function, sc.call)
+	}
+	if sc.file != "" {
+		return fmt.Sprintf("scriptfile:%s sha:%s call:%s", sc.file, sc.sha, sc.call)
+	}
+	return fmt.Sprintf("sha:%s call:%s", sc.sha, sc.call)
+}
+
+// getScriptConfig reads the script, nil is returned if neither a script nor a
+// function is configured.
+func getScriptConfig(script, scriptFile, function, call string) (*scriptConfig, error) {
+	if script != "" && scriptFile != "" {
+		return nil, fmt.Errorf("script and scriptfile are mutually exclusive")
+	}
+	if function != "" && (script != "" || scriptFile != "") {
+		return nil, fmt.Errorf("function can not be used with script or scriptfile")
+	}
+	if script == "" && scriptFile == "" && function == "" {
+		if call != "" {
+			return nil, fmt.Errorf("scriptcall requires script, scriptfile or function")
+		}
+		return nil, nil
+	}
+
+	sc := &scriptConfig{source: script, file: scriptFile, function: function, call: scriptCallRecord}
+	if call != "" {
+		sc.call = strings.ToLower(call)
+	}
+	if sc.call != scriptCallRecord && sc.call != scriptCallBatch {
+		return nil, fmt.Errorf("scriptcall must be one of %s or %s but is:%s", scriptCallRecord, scriptCallBatch, sc.call)
+	}
+	if scriptFile != "" {
+		source, err := os.ReadFile(scriptFile)
+		if err != nil {
+			return nil, fmt.Errorf("scriptfile can not be read: %w", err)
+		}
+		sc.source = string(source)
+		if strings.TrimSpace(sc.source) == "" {
+			return nil, fmt.Errorf("scriptfile %s is empty", scriptFile)
+		}
+	}
+	if sc.source != "" {
+		h := sha1.Sum([]byte(sc.source))
+		sc.sha = hex.EncodeToString(h[:])
+	}
+	return sc, nil
+}
+
+// batched returns true if the script is called once per key of a flush.
+func (sc *scriptConfig) batched() bool {
+	return sc != nil && sc.call == scriptCallBatch
+}
+
+// invoke returns the command which calls the script or function.
+func (sc *scriptConfig) invoke(key string, argv ...interface{}) (string, []interface{}) {
+	name, args := "EVALSHA", []interface{}{sc.sha, 1, key}
+	if sc.function != "" {
+		name, args = "FCALL", []interface{}{sc.function, 1, key}
+	}
+	return name, append(args, argv...)
+}
+
+// command returns the command which writes the message v to key.
+func (sc *scriptConfig) command(key string, v *logmessage) (string, []interface{}) {
+	return sc.invoke(key, v.data, v.tag)
+}
+
+// batchCommand returns the command which writes all values to key.
+func (sc *scriptConfig) batchCommand(key string, values []*logmessage) (string, []interface{}) {
+	argv := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		argv = append(argv, v.data)
+	}
+	return sc.invoke(key, argv...)
+}
+
+// load sends the script with SCRIPT LOAD, functions are loaded by the
+// administrator with FUNCTION LOAD.
+func (sc *scriptConfig) load(rd asyncConnection) error {
+	if sc.source == "" {
+		return nil
+	}
+	err := rd.Send("SCRIPT", "LOAD", sc.source)
+	if err != nil {
+		return err
+	}
+	err = rd.Flush()
+	if err != nil {
+		return err
+	}
+	sha, err := redis.String(rd.Receive())
+	if err != nil {
+		return err
+	}
+	if sha != sc.sha {
+		return fmt.Errorf("script was loaded with sha %s instead of %s", sha, sc.sha)
+	}
+	return nil
+}
+
+// pipeline sends the commands and reloads the script if redis replied
+// NOSCRIPT, e.g. after a restart. The commands which were rejected are sent again.
+func (sc *scriptConfig) pipeline(rd asyncConnection, cmds []*command) error {
+	errs, err := roundTrip(rd, cmds)
+	if err != nil {
+		return err
+	}
+	var (
+		missing []*command
+		indexes []int
+	)
+	for i, e := range errs {
+		if hasReply(e, "NOSCRIPT") {
+			missing = append(missing, cmds[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Printf("[out-redis] script %s is not loaded, loading it\n", sc.sha)
+		err := sc.load(rd)
+		if err != nil {
+			return &sendError{record: -1, permanent: isPermanentReply(err), err: denied(fmt.Errorf("error loading the script: %w", err))}
+		}
+		retried, err := roundTrip(rd, missing)
+		if err != nil {
+			return err
+		}
+		for j, i := range indexes {
+			errs[i] = retried[j]
+		}
+	}
+	return classify(cmds, errs)
+}
+
+// loadScript loads the script on all hosts, a host which is not available
+// loads it with the first NOSCRIPT.
+func (r *redisClient) loadScript() {
+	if r.script == nil || r.script.source == "" {
+		return
+	}
+	load := func(pool *redis.Pool, host string) {
+		conn := pool.Get()
+		defer conn.Close()
+		if err := r.script.load(conn); err != nil {
+			fmt.Printf("[out-redis] script %s could not be loaded on host %s: %v\n", r.script.sha, host, err)
+		}
+	}
+	if r.sentinel != nil {
+		pool, host, err := r.sentinel.getPool()
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			return
+		}
+		load(pool, host)
+		return
+	}
+	if r.pools != nil {
+		for i, pool := range r.pools.pools {
+			if pool != nil {
+				load(pool, r.pools.host(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testScript = "return redis.call('RPUSH', KEYS[1], ARGV[1])"
+
+// testScriptSHA is the sha1 of testScript.
+const testScriptSHA = "b9705020f551c492b7692cdba607bbdb64837972"
+
+func TestGetScriptConfig(t *testing.T) {
+	sc, err := getScriptConfig("", "", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, sc, "no script expected by default")
+
+	sc, err = getScriptConfig(testScript, "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, &scriptConfig{source: testScript, sha: testScriptSHA, call: scriptCallRecord}, sc)
+
+	file := filepath.Join(t.TempDir(), "write.lua")
+	require.NoError(t, os.WriteFile(file, []byte(testScript), 0600))
+	sc, err = getScriptConfig("", file, "", "Batch")
+	require.NoError(t, err)
+	assert.Equal(t, &scriptConfig{source: testScript, sha: testScriptSHA, file: file, call: scriptCallBatch}, sc)
+
+	sc, err = getScriptConfig("", "", "logs_write", "")
+	require.NoError(t, err)
+	assert.Equal(t, &scriptConfig{function: "logs_write", call: scriptCallRecord}, sc)
+
+	// invalid configurations
+	_, err = getScriptConfig(testScript, file, "", "")
+	assert.EqualError(t, err, "script and scriptfile are mutually exclusive")
+	_, err = getScriptConfig(testScript, "", "logs_write", "")
+	assert.EqualError(t, err, "function can not be used with script or scriptfile")
+	_, err = getScriptConfig("", "", "", "batch")
+	assert.EqualError(t, err, "scriptcall requires script, scriptfile or function")
+	_, err = getScriptConfig(testScript, "", "", "chunk")
+	assert.EqualError(t, err, "scriptcall must be one of record or batch but is:chunk")
+	_, err = getScriptConfig("", filepath.Join(t.TempDir(), "missing.lua"), "", "")
+	assert.ErrorContains(t, err, "scriptfile can not be read: open ")
+	empty := filepath.Join(t.TempDir(), "empty.lua")
+	require.NoError(t, os.WriteFile(empty, []byte("\n"), 0600))
+	_, err = getScriptConfig("", empty, "", "")
+	assert.EqualError(t, err, "scriptfile "+empty+" is empty")
+}
+
+func TestGetRedisConfigScript(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Script": testScript}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list script:{sha:"+testScriptSHA+" call:record}", c.String())
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"Function": "logs_write", "ScriptCall": "batch", "Cluster": "true"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, &scriptConfig{function: "logs_write", call: scriptCallBatch}, c.script, "functions can be used in cluster mode")
+
+	tests := []struct {
+		env mapEnvironment
+		err string
+	}{
+		{env: mapEnvironment{"Script": testScript, "DataType": "channel"}, err: "script and function can not be used with datatype channel"},
+		{env: mapEnvironment{"Script": testScript, "MaxLength": "10"}, err: "maxlength and pushdirection can not be used with script or function"},
+		{env: mapEnvironment{"Function": "logs_write", "DedupWindow": "60"}, err: "dedupwindow can not be used with script or function"},
+		{env: mapEnvironment{"Script": testScript, "Cluster": "true"}, err: "script can not be used in cluster mode, use function instead"},
+	}
+	for _, tt := range tests {
+		_, err := getRedisConfigFromEnv(tt.env.get)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestRedisSendScript(t *testing.T) {
+	sc, err := getScriptConfig(testScript, "", "", "")
+	require.NoError(t, err)
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), script: sc}
+	values := []*logmessage{{data: []byte("test1"), tag: "a"}, {data: []byte("test2"), tag: "b"}}
+
+	conn := &recordingConnection{}
+	err = rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), "a"},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test2"), "b"},
+	}, conn.commands)
+
+	sc.call = scriptCallBatch
+	conn = &recordingConnection{}
+	err = rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), []byte("test2")},
+	}, conn.commands)
+
+	// the records of a key are split by BatchSize and BatchBytes
+	rc.batch = &batchConfig{size: 2, bytes: 10}
+	values = append(values, &logmessage{data: []byte("test3")}, &logmessage{data: []byte("large record")}, &logmessage{data: []byte("test5")})
+	conn = &recordingConnection{replies: []interface{}{int64(1), redis.Error("ERR wrong number of arguments for 'rpush' command")}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 2: error setting key logstash to test3: ERR wrong number of arguments for 'rpush' command")
+	assert.Equal(t, [][]interface{}{
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), []byte("test2")},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test3")},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("large record")},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test5")},
+	}, conn.commands)
+}
+
+func TestRedisSendFunction(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), script: &scriptConfig{function: "logs_write", call: scriptCallRecord}}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", []*logmessage{{data: []byte("test1"), tag: "a"}})
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"FCALL", "logs_write", 1, "logstash", []byte("test1"), "a"},
+	}, conn.commands)
+
+	// a missing function is retried, it may be loaded later
+	conn = &recordingConnection{replies: []interface{}{redis.Error("ERR Function not found")}}
+	err = rc.sendImpl(conn, "", []*logmessage{{data: []byte("test1")}})
+	assert.EqualError(t, err, "record 0: error setting key logstash to test1: ERR Function not found")
+	assert.False(t, isPermanent(err))
+}
+
+func TestRedisSendScriptReload(t *testing.T) {
+	sc, err := getScriptConfig(testScript, "", "", "")
+	require.NoError(t, err)
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), script: sc}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}, {data: []byte("test3")}}
+	noScript := redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+
+	// the script was loaded by another flush while the first record was rejected
+	conn := &recordingConnection{replies: []interface{}{noScript, int64(1), noScript, testScriptSHA, int64(2), int64(3)}}
+	err = rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "the rejected records should be sent again")
+	assert.Equal(t, [][]interface{}{
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), ""},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test2"), ""},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test3"), ""},
+		{"SCRIPT", "LOAD", testScript},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), ""},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test3"), ""},
+	}, conn.commands)
+
+	// the script can not be loaded
+	conn = &recordingConnection{replies: []interface{}{noScript, noScript, noScript, redis.Error("NOPERM this user has no permissions to run the 'script|load' command")}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "permission denied by the acl of the redis user: error loading the script: NOPERM this user has no permissions to run the 'script|load' command")
+	assert.True(t, isPermanent(err))
+
+	// still missing after the load, e.g. because of a SCRIPT FLUSH
+	conn = &recordingConnection{replies: []interface{}{noScript, int64(1), int64(2), testScriptSHA, noScript}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 0: error setting key logstash to test1: NOSCRIPT No matching script. Please use EVAL.")
+	assert.False(t, isPermanent(err), "the flush should be retried")
+}
+
+func TestRedisSendScriptTransactional(t *testing.T) {
+	sc, err := getScriptConfig(testScript, "", "", "")
+	require.NoError(t, err)
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), script: sc, transactional: true}
+
+	conn := &recordingConnection{replies: []interface{}{testScriptSHA, "OK", "QUEUED", []interface{}{int64(1)}}}
+	err = rc.sendImpl(conn, "", []*logmessage{{data: []byte("test1")}})
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"SCRIPT", "LOAD", testScript},
+		{"MULTI"},
+		{"EVALSHA", testScriptSHA, 1, "logstash", []byte("test1"), ""},
+		{"EXEC"},
+	}, conn.commands)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	switchMasterChannel = "+switch-master"
+	// sentinelRetryInterval is the pause before the next sentinel is watched.
+	sentinelRetryInterval = time.Second
+	// sentinelPingInterval is the interval in which the subscription is
+	// checked with PING. The subscription waits for messages without the
+	// ReadTimeout, it fails if not even the PONG is received within two intervals.
+	sentinelPingInterval = 30 * time.Second
+)
+
+var errNotMaster = errors.New("redis is not a master")
+
+// A redisSentinel resolves the current master of a sentinel monitored redis
+// and replaces the pool of the master after a failover.
+type redisSentinel struct {
+	sentinels []string
+	master    string
+	// dial connects to a sentinel, replaceable for tests.
+	dial func(addr string) (redis.Conn, error)
+	// newPool creates the pool of the master at addr.
+	newPool func(addr string) (*redis.Pool, error)
+
+	mu   sync.RWMutex
+	addr string
+	pool *redis.Pool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func getSentinelHosts(hosts string) ([]string, error) {
+	var sentinels []string
+	for _, host := range strings.Fields(hosts) {
+		if !strings.Contains(host, ":") {
+			host = net.JoinHostPort(host, "26379")
+		}
+		_, p, err := net.SplitHostPort(host)
+		if err != nil {
+			return nil, fmt.Errorf("sentinelhosts must be in the form host:port but is:%s", host)
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("port must be numeric:%w", err)
+		}
+		if port < 0 || port > 65535 {
+			return nil, fmt.Errorf("port must between 0-65535 not:%d", port)
+		}
+		sentinels = append(sentinels, host)
+	}
+	return sentinels, nil
+}
+
+func newSentinelFromConfig(rc *redisConfig) *redisSentinel {
+	s := &redisSentinel{
+		sentinels: rc.sentinelHosts,
+		master:    rc.sentinelMaster,
+		dial: func(addr string) (redis.Conn, error) {
+			options := append(rc.pool.dialOptions(0),
+				redis.DialUseTLS(rc.usetls),
+				redis.DialTLSConfig(rc.tls.config(rc.tlsskipverify)),
+			)
+			c, err := redis.Dial("tcp", addr, options...)
+			if err != nil {
+				return nil, err
+			}
+			if rc.sentinelPassword != "" {
+				if _, err := c.Do("AUTH", rc.sentinelPassword); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+		done: make(chan struct{}),
+	}
+	s.newPool = func(addr string) (*redis.Pool, error) {
+		host, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("port must be numeric:%w", err)
+		}
+		pool := newHostPool(rc.nodeHost(host, port))
+		dial := pool.Dial
+		pool.Dial = func() (redis.Conn, error) {
+			c, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			// after a failover the old master may still be reachable as replica
+			if err := checkMaster(c); err != nil {
+				c.Close()
+				go s.resolve() // nolint:errcheck
+				return nil, fmt.Errorf("%s: %w", addr, err)
+			}
+			return c, nil
+		}
+		return pool, nil
+	}
+	return s
+}
+
+// checkMaster returns errNotMaster if the connection does not point to a master.
+func checkMaster(c redis.Conn) error {
+	values, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("empty reply to ROLE")
+	}
+	role, err := redis.String(values[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("role is %s: %w", role, errNotMaster)
+	}
+	return nil
+}
+
+// getPool returns the pool and the address of the current master.
+func (s *redisSentinel) getPool() (*redis.Pool, string, error) {
+	s.mu.RLock()
+	pool, addr := s.pool, s.addr
+	s.mu.RUnlock()
+	if pool != nil {
+		return pool, addr, nil
+	}
+	if err := s.resolve(); err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pool, s.addr, nil
+}
+
+// resolve asks the sentinels for the address of the master.
+func (s *redisSentinel) resolve() error {
+	var lastErr error
+	for _, sentinel := range s.sentinels {
+		addr, err := s.masterAddr(sentinel)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return s.switchMaster(addr)
+	}
+	return fmt.Errorf("unable to resolve master %s from sentinels: %w", s.master, lastErr)
+}
+
+func (s *redisSentinel) masterAddr(sentinel string) (string, error) {
+	c, err := s.dial(sentinel)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	values, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.master))
+	if err != nil {
+		if errors.Is(err, redis.ErrNil) {
+			return "", fmt.Errorf("sentinel %s does not know master %s", sentinel, s.master)
+		}
+		return "", fmt.Errorf("sentinel %s: %w", sentinel, err)
+	}
+	if len(values) != 2 {
+		return "", fmt.Errorf("sentinel %s replied an invalid master address: %v", sentinel, values)
+	}
+	return net.JoinHostPort(values[0], values[1]), nil
+}
+
+// switchMaster replaces the pool if the master moved to addr.
+func (s *redisSentinel) switchMaster(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.addr == addr && s.pool != nil {
+		return nil
+	}
+	pool, err := s.newPool(addr)
+	if err != nil {
+		return err
+	}
+	if s.pool != nil {
+		fmt.Printf("[out-redis] master %s switched from %s to %s\n", s.master, s.addr, addr)
+		// connections in use are closed when they are returned
+		s.pool.Close()
+	}
+	s.addr = addr
+	s.pool = pool
+	return nil
+}
+
+// handleSwitch processes a +switch-master message, which has the form
+// "<master name> <old ip> <old port> <new ip> <new port>".
+func (s *redisSentinel) handleSwitch(message string) error {
+	fields := strings.Fields(message)
+	if len(fields) != 5 {
+		return fmt.Errorf("invalid %s message: %s", switchMasterChannel, message)
+	}
+	if fields[0] != s.master {
+		return nil
+	}
+	return s.switchMaster(net.JoinHostPort(fields[3], fields[4]))
+}
+
+// start watches the sentinels for failovers in the background.
+func (s *redisSentinel) start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for i := 0; ; i++ {
+			err := s.watch(s.sentinels[i%len(s.sentinels)])
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			fmt.Printf("[out-redis] watching sentinel failed: %v\n", err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(sentinelRetryInterval):
+			}
+		}
+	}()
+}
+
+// watch subscribes to +switch-master at the sentinel until the connection fails
+// or the sentinel is closed.
+func (s *redisSentinel) watch(sentinel string) error {
+	c, err := s.dial(sentinel)
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(sentinelPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				psc.Close()
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				// a failed ping breaks the subscription
+				psc.Ping("") // nolint:errcheck
+			}
+		}
+	}()
+
+	if err := psc.Subscribe(switchMasterChannel); err != nil {
+		return err
+	}
+	// a failover may have happened while no sentinel was watched
+	if err := s.resolve(); err != nil {
+		fmt.Printf("[out-redis] %v\n", err)
+	}
+	for {
+		switch msg := psc.ReceiveWithTimeout(2 * sentinelPingInterval).(type) {
+		case redis.Message:
+			if err := s.handleSwitch(string(msg.Data)); err != nil {
+				fmt.Printf("[out-redis] %v\n", err)
+			}
+		case error:
+			return fmt.Errorf("sentinel %s: %w", sentinel, msg)
+		}
+	}
+}
+
+func (s *redisSentinel) close() {
+	close(s.done)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool != nil {
+		s.pool.Close()
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A fakeSentinelConn answers SENTINEL and ROLE commands and delivers pubsub messages.
+type fakeSentinelConn struct {
+	master   []string
+	role     string
+	messages []interface{}
+	// timeouts are the timeouts of ReceiveWithTimeout
+	timeouts []time.Duration
+}
+
+func (c *fakeSentinelConn) Close() error                               { return nil }
+func (c *fakeSentinelConn) Err() error                                 { return nil }
+func (c *fakeSentinelConn) Flush() error                               { return nil }
+func (c *fakeSentinelConn) Send(cmd string, args ...interface{}) error { return nil }
+
+func (c *fakeSentinelConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "SENTINEL":
+		if c.master == nil {
+			return nil, nil
+		}
+		return []interface{}{[]byte(c.master[0]), []byte(c.master[1])}, nil
+	case "ROLE":
+		return []interface{}{[]byte(c.role), int64(0)}, nil
+	}
+	return nil, fmt.Errorf("unexpected command %s", cmd)
+}
+
+func (c *fakeSentinelConn) Receive() (interface{}, error) {
+	if len(c.messages) == 0 {
+		return nil, fmt.Errorf("connection closed")
+	}
+	msg := c.messages[0]
+	c.messages = c.messages[1:]
+	return msg, nil
+}
+
+func (c *fakeSentinelConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.Do(cmd, args...)
+}
+
+func (c *fakeSentinelConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	c.timeouts = append(c.timeouts, timeout)
+	return c.Receive()
+}
+
+func newTestSentinel(conns map[string]*fakeSentinelConn) *redisSentinel {
+	return &redisSentinel{
+		sentinels: []string{"10.0.0.1:26379", "10.0.0.2:26379"},
+		master:    "mymaster",
+		dial: func(addr string) (redis.Conn, error) {
+			c, ok := conns[addr]
+			if !ok {
+				return nil, fmt.Errorf("dial tcp %s: connection refused", addr)
+			}
+			return c, nil
+		},
+		newPool: func(addr string) (*redis.Pool, error) {
+			return &redis.Pool{}, nil
+		},
+		done: make(chan struct{}),
+	}
+}
+
+func TestGetSentinelHosts(t *testing.T) {
+	hosts, err := getSentinelHosts("")
+	assert.NoError(t, err)
+	assert.Empty(t, hosts)
+
+	hosts, err = getSentinelHosts("10.0.0.1 10.0.0.2:26380")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:26379", "10.0.0.2:26380"}, hosts, "26379 should be the default port")
+
+	_, err = getSentinelHosts("10.0.0.1:port")
+	assert.EqualError(t, err, "port must be numeric:strconv.Atoi: parsing \"port\": invalid syntax")
+
+	_, err = getSentinelHosts("10.0.0.1:65536")
+	assert.EqualError(t, err, "port must between 0-65535 not:65536")
+}
+
+func TestGetRedisConfigFromEnvSentinel(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"SentinelHosts": "10.0.0.1 10.0.0.2", "SentinelMaster": "mymaster"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:26379", "10.0.0.2:26379"}, c.sentinelHosts)
+	assert.Equal(t, "mymaster", c.sentinelMaster)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list sentinelhosts:[10.0.0.1:26379 10.0.0.2:26379] sentinelmaster:mymaster", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"SentinelHosts": "10.0.0.1"}.get)
+	assert.EqualError(t, err, "sentinelmaster is required with sentinelhosts")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"SentinelHosts": "10.0.0.1", "SentinelMaster": "mymaster", "Cluster": "true"}.get)
+	assert.EqualError(t, err, "sentinelhosts can not be used in cluster mode")
+}
+
+func TestSentinelResolve(t *testing.T) {
+	// the first sentinel is down
+	s := newTestSentinel(map[string]*fakeSentinelConn{
+		"10.0.0.2:26379": {master: []string{"10.0.0.5", "6379"}},
+	})
+	pool, _, err := s.getPool()
+	require.NoError(t, err)
+	assert.NotNil(t, pool)
+	assert.Equal(t, "10.0.0.5:6379", s.addr)
+
+	// the same master keeps the pool
+	require.NoError(t, s.resolve())
+	p, _, err := s.getPool()
+	require.NoError(t, err)
+	assert.Same(t, pool, p, "the pool should not be replaced without failover")
+
+	// no sentinel knows the master
+	s = newTestSentinel(map[string]*fakeSentinelConn{
+		"10.0.0.1:26379": {},
+	})
+	_, _, err = s.getPool()
+	assert.EqualError(t, err, "unable to resolve master mymaster from sentinels: dial tcp 10.0.0.2:26379: connection refused")
+}
+
+func TestSentinelSwitchMaster(t *testing.T) {
+	s := newTestSentinel(map[string]*fakeSentinelConn{
+		"10.0.0.1:26379": {master: []string{"10.0.0.5", "6379"}},
+	})
+	pool, _, err := s.getPool()
+	require.NoError(t, err)
+
+	// messages of other masters are ignored
+	require.NoError(t, s.handleSwitch("othermaster 10.0.0.5 6379 10.0.0.9 6379"))
+	assert.Equal(t, "10.0.0.5:6379", s.addr)
+
+	require.NoError(t, s.handleSwitch("mymaster 10.0.0.5 6379 10.0.0.6 6380"))
+	assert.Equal(t, "10.0.0.6:6380", s.addr)
+	p, _, err := s.getPool()
+	require.NoError(t, err)
+	assert.NotSame(t, pool, p, "the pool should be replaced after a failover")
+
+	assert.EqualError(t, s.handleSwitch("mymaster 10.0.0.5"), "invalid +switch-master message: mymaster 10.0.0.5")
+}
+
+func TestSentinelWatch(t *testing.T) {
+	conns := map[string]*fakeSentinelConn{
+		"10.0.0.1:26379": {
+			master: []string{"10.0.0.5", "6379"},
+			messages: []interface{}{
+				[]interface{}{[]byte("subscribe"), []byte("+switch-master"), int64(1)},
+				[]interface{}{[]byte("message"), []byte("+switch-master"), []byte("mymaster 10.0.0.5 6379 10.0.0.6 6379")},
+			},
+		},
+	}
+	s := newTestSentinel(conns)
+	err := s.watch("10.0.0.1:26379")
+	assert.EqualError(t, err, "sentinel 10.0.0.1:26379: connection closed")
+	assert.Equal(t, "10.0.0.6:6379", s.addr, "the master should be switched")
+	require.NotEmpty(t, conns["10.0.0.1:26379"].timeouts)
+	for _, timeout := range conns["10.0.0.1:26379"].timeouts {
+		assert.Equal(t, 60*time.Second, timeout, "the subscription must not fail with the ReadTimeout")
+	}
+}
+
+func TestCheckMaster(t *testing.T) {
+	assert.NoError(t, checkMaster(&fakeSentinelConn{role: "master"}))
+	err := checkMaster(&fakeSentinelConn{role: "slave"})
+	assert.True(t, errors.Is(err, errNotMaster), "a replica must not be used")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+func getShardBy(shardBy, fallback string) (*keyTemplate, error) {
+	if shardBy == "" {
+		return nil, nil
+	}
+	if shardBy == tagPlaceholder {
+		shardBy = tagField
+	}
+	return newKeyTemplate("${"+shardBy+"}", fallback)
+}
+
+// rank returns the indexes of all pools ordered by their rendezvous weight for
+// the shard, the first pool owns the shard. Adding or removing a host only
+// moves the shards owned by this host.
+func (rp *redisPools) rank(shard string) []int {
+	weights := make([]uint64, len(rp.pools))
+	indexes := make([]int, 0, len(rp.pools))
+	for i, pool := range rp.pools {
+		if pool == nil {
+			continue
+		}
+		weights[i] = rendezvousWeight(rp.host(i), shard)
+		indexes = append(indexes, i)
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return weights[indexes[a]] > weights[indexes[b]]
+	})
+	return indexes
+}
+
+func rendezvousWeight(host, shard string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(host))  // nolint:errcheck
+	h.Write([]byte{0})     // nolint:errcheck
+	h.Write([]byte(shard)) // nolint:errcheck
+	// fnv does not spread similar inputs well, finalize it like splitmix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// owner returns the first healthy pool of the ranking which is not excluded,
+// or the first one which is not excluded if all are ejected, -1 if all are excluded.
+func (rp *redisPools) owner(ranking []int, excluded map[int]bool) int {
+	owner := -1
+	for _, i := range ranking {
+		if excluded[i] {
+			continue
+		}
+		if i >= len(rp.health) || !rp.health[i].isEjected() {
+			return i
+		}
+		if owner < 0 {
+			owner = i
+		}
+	}
+	return owner
+}
+
+// A shardGroup holds the messages of a flush which are sent to the same pool.
+type shardGroup struct {
+	pool   int
+	values []*logmessage
+	// indexes holds the position of every message in the flush
+	indexes []int
+}
+
+// groupByShard splits the messages at the given positions by the pool which
+// owns their shard, the order of the messages per pool is kept.
+func (r *redisClient) groupByShard(values []*logmessage, positions []int, excluded map[int]bool) ([]*shardGroup, []int) {
+	var (
+		groups   []*shardGroup
+		orphaned []int
+	)
+	byPool := make(map[int]*shardGroup)
+	owners := make(map[string]int)
+	for _, i := range positions {
+		shard := r.shardBy.resolve(values[i])
+		owner, ok := owners[shard]
+		if !ok {
+			owner = r.pools.owner(r.pools.rank(shard), excluded)
+			owners[shard] = owner
+		}
+		if owner < 0 {
+			orphaned = append(orphaned, i)
+			continue
+		}
+		g, ok := byPool[owner]
+		if !ok {
+			g = &shardGroup{pool: owner}
+			byPool[owner] = g
+			groups = append(groups, g)
+		}
+		g.values = append(g.values, values[i])
+		g.indexes = append(g.indexes, i)
+	}
+	return groups, orphaned
+}
+
+// sendSharded sends every message to the pool which owns its shard. The
+// messages of a failed pool are sent to the next pool of their ranking.
+func (r *redisClient) sendSharded(values []*logmessage) error {
+	if len(r.pools.pools) == 0 {
+		return errors.New("pool is empty")
+	}
+	positions := make([]int, len(values))
+	for i := range values {
+		positions[i] = i
+	}
+	excluded := make(map[int]bool)
+	var lastErr, unheard error
+	for len(positions) > 0 {
+		groups, orphaned := r.groupByShard(values, positions, excluded)
+		if len(orphaned) > 0 {
+			// all hosts failed
+			return lastErr
+		}
+		positions = nil
+		for _, g := range groups {
+			err := r.sendTo(r.pools.pools[g.pool], r.pools.host(g.pool), g.values)
+			if err == nil {
+				r.pools.success(g.pool)
+				continue
+			}
+			if errors.Is(err, errNoSubscribers) {
+				// the logs are published, another host would publish them again
+				r.pools.success(g.pool)
+				unheard = err
+				continue
+			}
+			var se *sendError
+			if !errors.As(err, &se) {
+				return err
+			}
+			if se.record >= 0 {
+				// the position in the flush instead of the group
+				se.record = g.indexes[se.record]
+			}
+			if se.permanent {
+				// the host is not to blame
+				return err
+			}
+			fmt.Printf("%v\n", err)
+			if blamesHost(err) {
+				r.pools.failure(g.pool, err)
+			}
+			excluded[g.pool] = true
+			positions = append(positions, g.indexes...)
+			lastErr = err
+		}
+		sort.Ints(positions)
+	}
+	return unheard
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRankPools(n int) *redisPools {
+	rp := &redisPools{}
+	for i := 0; i < n; i++ {
+		rp.pools = append(rp.pools, &redis.Pool{})
+		rp.hosts = append(rp.hosts, fmt.Sprintf("10.0.0.%d:6379", i+1))
+		rp.health = append(rp.health, &poolHealth{})
+	}
+	return rp
+}
+
+func TestGetRedisConfigFromEnvShardBy(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Hosts": "a b", "ShardBy": "kubernetes.pod_name"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{a 6379} {b 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list shardby:kubernetes.pod_name", c.String())
+	assert.Equal(t, "web-1", c.shardTemplate.resolve(&logmessage{record: map[string]interface{}{"kubernetes": map[string]interface{}{"pod_name": "web-1"}}}))
+	assert.Equal(t, "unknown", c.shardTemplate.resolve(&logmessage{}), "records without the field should share a shard")
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"ShardBy": "@tag"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "app", c.shardTemplate.resolve(&logmessage{tag: "app"}))
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"ShardBy": "a..b"}.get)
+	assert.EqualError(t, err, "shardby is invalid: key contains an invalid placeholder in ${a..b}: field \"a..b\" contains an empty path element")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"ShardBy": "tag", "Cluster": "true"}.get)
+	assert.EqualError(t, err, "shardby can not be used in cluster mode")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"ShardBy": "tag", "WriteMode": "all"}.get)
+	assert.EqualError(t, err, "shardby can not be used with writemode all")
+}
+
+func TestRendezvousRank(t *testing.T) {
+	three, four := newRankPools(3), newRankPools(4)
+
+	owners := make(map[int]int)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		shard := fmt.Sprintf("pod-%d", i)
+		ranking := three.rank(shard)
+		require.Len(t, ranking, 3)
+		assert.Equal(t, ranking, three.rank(shard), "the ranking should be stable")
+		owners[ranking[0]]++
+
+		// adding a host only moves shards to the new host
+		owner := four.rank(shard)[0]
+		if owner != ranking[0] {
+			assert.Equal(t, 3, owner, "a shard should only move to the new host")
+			moved++
+		}
+	}
+	for i := 0; i < 3; i++ {
+		assert.InDelta(t, 333, owners[i], 60, "the shards should be spread evenly")
+	}
+	assert.InDelta(t, 250, moved, 60, "a quarter of the shards should move to the new host")
+}
+
+func TestPoolsOwner(t *testing.T) {
+	rp := newRankPools(3)
+	ranking := []int{2, 0, 1}
+	assert.Equal(t, 2, rp.owner(ranking, nil))
+	assert.Equal(t, 0, rp.owner(ranking, map[int]bool{2: true}))
+
+	rp.health[0].failure(&healthConfig{failures: 1, backoff: time.Hour})
+	assert.Equal(t, 1, rp.owner(ranking, map[int]bool{2: true}), "ejected hosts should be skipped")
+	assert.Equal(t, 0, rp.owner(ranking, map[int]bool{1: true, 2: true}), "ejected hosts should be used if no other is left")
+	assert.Equal(t, -1, rp.owner(ranking, map[int]bool{0: true, 1: true, 2: true}))
+}
+
+func TestRedisSendSharded(t *testing.T) {
+	hosts := []*fakeHost{{up: true}, {up: true}, {up: true}}
+	rc := &redisClient{
+		key:     mustKeyTemplate(t, "logs"),
+		shardBy: mustKeyTemplate(t, "${pod}"),
+		pools:   newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, hosts...),
+	}
+	var values []*logmessage
+	expected := make([]int, len(hosts))
+	for i := 0; i < 30; i++ {
+		pod := fmt.Sprintf("pod-%d", i%10)
+		values = append(values, &logmessage{data: []byte(pod), record: map[string]interface{}{"pod": pod}})
+		expected[rc.pools.rank(pod)[0]]++
+	}
+
+	require.NoError(t, rc.send(values))
+	for i, h := range hosts {
+		assert.Equal(t, expected[i], h.sends, "every record should be sent to the owner of its shard")
+	}
+
+	// the records of a failed host are sent to the next host
+	owner := rc.pools.rank("pod-0")[0]
+	hosts[owner].up = false
+	sends := 0
+	for _, h := range hosts {
+		sends -= h.sends
+	}
+	require.NoError(t, rc.send(values))
+	for _, h := range hosts {
+		sends += h.sends
+	}
+	assert.Equal(t, len(values), sends, "every record should be sent once")
+	assert.True(t, rc.pools.health[owner].isEjected())
+
+	// all hosts are down
+	for _, h := range hosts {
+		h.up = false
+	}
+	err := rc.send(values)
+	assert.Error(t, err)
+	assert.False(t, isPermanent(err))
+}
+
+func TestRedisSendShardedRecordIndex(t *testing.T) {
+	hosts := []*fakeHost{{up: true}, {up: true}}
+	rc := &redisClient{
+		key:     mustKeyTemplate(t, "logs"),
+		shardBy: mustKeyTemplate(t, "${pod}"),
+		pools:   newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, hosts...),
+	}
+	// find two pods owned by different hosts
+	pods := map[int]string{}
+	for i := 0; len(pods) < 2; i++ {
+		pod := fmt.Sprintf("pod-%d", i)
+		if _, ok := pods[rc.pools.rank(pod)[0]]; !ok {
+			pods[rc.pools.rank(pod)[0]] = pod
+		}
+	}
+	hosts[1].reply = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	values := []*logmessage{
+		{data: []byte("a"), record: map[string]interface{}{"pod": pods[0]}},
+		{data: []byte("b"), record: map[string]interface{}{"pod": pods[1]}},
+	}
+	err := rc.send(values)
+	assert.EqualError(t, err, "host 10.0.0.2:6379: record 1: error setting key logs to b: WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.True(t, isPermanent(err))
+}
+
+func TestRedisSendShardedWithoutSubscribers(t *testing.T) {
+	hosts := []*fakeHost{{up: true, noSubscribers: true}, {up: true, noSubscribers: true}}
+	rc := &redisClient{
+		key:           mustKeyTemplate(t, "logs"),
+		dataType:      dataTypeChannel,
+		noSubscribers: noSubscribersRetry,
+		shardBy:       mustKeyTemplate(t, "${pod}"),
+		pools:         newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, hosts...),
+	}
+	var values []*logmessage
+	for i := 0; i < 10; i++ {
+		pod := fmt.Sprintf("pod-%d", i)
+		values = append(values, &logmessage{data: []byte(pod), record: map[string]interface{}{"pod": pod}})
+	}
+
+	err := rc.send(values)
+	assert.ErrorIs(t, err, errNoSubscribers)
+	assert.Equal(t, len(values), hosts[0].sends+hosts[1].sends, "every log should be published once")
+	for i := range hosts {
+		assert.False(t, rc.pools.health[i].isEjected(), "a host without subscribers is healthy")
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultSpoolMaxSize        = 100 << 20
+	defaultSpoolReplayInterval = 5 * time.Second
+
+	// spoolMagic starts every spool file, followed by spoolVersion.
+	spoolMagic   = "FBRSPOOL"
+	spoolVersion = 1
+	spoolSuffix  = ".spool"
+	// spoolLock is locked by the spool which uses the directory.
+	spoolLock = "spool.lock"
+)
+
+// errSpoolFull is returned if a flush does not fit into the spool anymore.
+var errSpoolFull = errors.New("spool is full")
+
+// A spool persists flushes which could not be written because no host was
+// available, and replays them in order once a host is back. Every flush is a
+// file of its own, the files are named by a sequence number:
+//
+//	00000000000000000042.spool
+//
+// A file starts with the magic "FBRSPOOL" and a version byte 1, followed by
+// the records of the flush in their order. Every record is
+//
+//	uvarint length of the tag, tag
+//	varint  timestamp in unix nanoseconds
+//	uvarint length of the json, json
+//
+// A file is written to a temporary file first and renamed when it is
+// complete, so a crash never leaves a partial file behind. The directory is
+// locked with flock on spool.lock, so neither another output instance nor
+// another fluent-bit overwrites or replays the files. The lock is released by
+// the kernel if the process dies.
+type spool struct {
+	dir      string
+	maxSize  int64
+	interval time.Duration
+	lock     *os.File
+
+	mu    sync.Mutex
+	files []spoolFile
+	size  int64
+	next  uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type spoolFile struct {
+	seq  uint64
+	size int64
+}
+
+// openSpool returns nil if no dir is configured. Files left by a previous run
+// are replayed.
+func openSpool(dir, maxSize, interval string) (*spool, error) {
+	if dir == "" {
+		if maxSize != "" || interval != "" {
+			return nil, fmt.Errorf("spoolmaxsize and spoolreplayinterval require spooldir")
+		}
+		return nil, nil
+	}
+	s := &spool{dir: dir, maxSize: defaultSpoolMaxSize, interval: defaultSpoolReplayInterval}
+	if maxSize != "" {
+		size, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("spoolmaxsize must be a integer: %w", err)
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("spoolmaxsize must be greater than 0 but is:%d", size)
+		}
+		s.maxSize = size
+	}
+	if interval != "" {
+		d, err := getTimeout("spoolreplayinterval", interval)
+		if err != nil {
+			return nil, err
+		}
+		if d == 0 {
+			return nil, fmt.Errorf("spoolreplayinterval must be greater than 0")
+		}
+		s.interval = d
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("spooldir can not be created: %w", err)
+	}
+	s.lock, err = lockSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = s.scan()
+	if err != nil {
+		s.lock.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// lockSpool takes the exclusive lock of the directory.
+func lockSpool(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, spoolLock), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("spooldir can not be locked: %w", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("spooldir %s is used by another output instance, every instance needs a spooldir of its own", dir)
+		}
+		return nil, fmt.Errorf("spooldir can not be locked: %w", err)
+	}
+	return f, nil
+}
+
+// scan reads the files left by a previous run.
+func (s *spool) scan() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("spooldir can not be read: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, spoolSuffix+".tmp") {
+			// left by a crash while the file was written
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("spooldir can not be read: %w", err)
+		}
+		s.files = append(s.files, spoolFile{seq: seq, size: info.Size()})
+		s.size += info.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].seq < s.files[j].seq })
+	return nil
+}
+
+func (s *spool) String() string {
+	return fmt.Sprintf("spooldir:%s spoolmaxsize:%d spoolreplayinterval:%s", s.dir, s.maxSize, s.interval)
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// pending returns true if flushes wait to be replayed.
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files) > 0
+}
+
+// add persists the values as the newest flush of the spool.
+func (s *spool) add(values []*logmessage) error {
+	data := encodeSpool(values)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+int64(len(data)) > s.maxSize {
+		return fmt.Errorf("%w, %d of %d bytes are used", errSpoolFull, s.size, s.maxSize)
+	}
+	seq := s.next
+	path := s.path(seq)
+	tmp := path + ".tmp"
+	err := writeSynced(tmp, data)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing the spool: %w", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error writing the spool: %w", err)
+	}
+	s.next++
+	s.files = append(s.files, spoolFile{seq: seq, size: int64(len(data))})
+	s.size += int64(len(data))
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// oldest returns the sequence number of the oldest flush.
+func (s *spool) oldest() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) == 0 {
+		return 0, false
+	}
+	return s.files[0].seq, true
+}
+
+// remove deletes the oldest flush after it was replayed.
+func (s *spool) remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) == 0 || s.files[0].seq != seq {
+		return nil
+	}
+	err := os.Remove(s.path(seq))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.size -= s.files[0].size
+	s.files = s.files[1:]
+	return nil
+}
+
+// replay sends the spooled flushes in order until the spool is empty, a
+// flush fails with a retryable error or the spool is closed.
+func (s *spool) replay(send func([]*logmessage) error) {
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		seq, ok := s.oldest()
+		if !ok {
+			return
+		}
+		values, err := readSpool(s.path(seq))
+		if err == nil {
+			err = send(values)
+			switch {
+			case err == nil:
+				fmt.Printf("[out-redis] replayed %d spooled logs\n", len(values))
+			case isPermanent(err):
+				// fluent-bit drops a chunk with such an error as well
+				fmt.Printf("[out-redis] dropping %d spooled logs: %v\n", len(values), err)
+			default:
+				fmt.Printf("[out-redis] spooled logs can not be replayed yet: %v\n", err)
+				return
+			}
+		} else {
+			fmt.Printf("[out-redis] dropping spool file %s: %v\n", s.path(seq), err)
+		}
+		if err := s.remove(seq); err != nil {
+			fmt.Printf("[out-redis] %v\n", err)
+			return
+		}
+	}
+}
+
+// start replays the spool in the background until close is called.
+func (s *spool) start(send func([]*logmessage) error) {
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.replay(send)
+			}
+		}
+	}()
+}
+
+// close stops the replay and releases the lock of the directory.
+func (s *spool) close() {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+	}
+	s.lock.Close()
+}
+
+// encodeSpool returns the content of a spool file with the values.
+func encodeSpool(values []*logmessage) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(spoolMagic)
+	buf.WriteByte(spoolVersion)
+	var n [binary.MaxVarintLen64]byte
+	for _, v := range values {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(v.tag)))])
+		buf.WriteString(v.tag)
+		buf.Write(n[:binary.PutVarint(n[:], v.timestamp.UnixNano())])
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(v.data)))])
+		buf.Write(v.data)
+	}
+	return buf.Bytes()
+}
+
+// readSpool reads the values of a spool file. The records are parsed from
+// their json again, numbers are kept as they are.
+func readSpool(path string) ([]*logmessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(spoolMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(spoolMagic)]) != spoolMagic {
+		return nil, fmt.Errorf("not a spool file")
+	}
+	if header[len(spoolMagic)] != spoolVersion {
+		return nil, fmt.Errorf("unknown spool version %d", header[len(spoolMagic)])
+	}
+
+	var values []*logmessage
+	for {
+		tag, err := readSpoolBytes(r)
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("spool file is truncated: %w", err)
+		}
+		ts, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("spool file is truncated: %w", err)
+		}
+		data, err := readSpoolBytes(r)
+		if err != nil {
+			return nil, fmt.Errorf("spool file is truncated: %w", err)
+		}
+		record := make(map[string]interface{})
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&record); err != nil {
+			return nil, fmt.Errorf("spooled record is invalid: %w", err)
+		}
+		values = append(values, &logmessage{data: data, record: record, tag: string(tag), timestamp: time.Unix(0, ts)})
+	}
+}
+
+// readSpoolBytes reads a length prefixed field, io.EOF is returned if the
+// file ends before the field.
+func readSpoolBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// deliver sends the values or, if no host is available, persists them in the
+// spool. While the spool is replayed, new flushes are spooled too, so the
+// order is kept. Errors replied by redis, e.g. OOM, and backpressure are
+// returned, fluent-bit retries the flush then.
+func (r *redisClient) deliver(values []*logmessage) error {
+	if r.spool == nil {
+		return r.send(values)
+	}
+	if r.spool.pending() {
+		return r.spool.add(values)
+	}
+	err := r.send(values)
+	if !unavailable(err) {
+		return err
+	}
+	if serr := r.spool.add(values); serr != nil {
+		fmt.Printf("[out-redis] %v\n", serr)
+		return err
+	}
+	fmt.Printf("[out-redis] spooled %d logs: %v\n", len(values), err)
+	return nil
+}
+
+// unavailable returns true if err is a retryable error of the connection to a
+// host, e.g. the host is down or timed out.
+func unavailable(err error) bool {
+	var se *sendError
+	if !errors.As(err, &se) || se.permanent || errors.Is(err, errBackpressure) || errors.Is(err, errNoSubscribers) {
+		return false
+	}
+	return !isReply(err)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenSpool(t *testing.T) {
+	s, err := openSpool("", "", "")
+	require.NoError(t, err)
+	assert.Nil(t, s, "no spool expected by default")
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	s, err = openSpool(dir, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100<<20), s.maxSize)
+	assert.Equal(t, 5*time.Second, s.interval)
+	assert.DirExists(t, dir)
+
+	// the directory is locked until the spool is closed
+	_, err = openSpool(dir, "", "")
+	assert.EqualError(t, err, "spooldir "+dir+" is used by another output instance, every instance needs a spooldir of its own")
+	s.close()
+
+	s, err = openSpool(dir, "1024", "1m")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), s.maxSize)
+	assert.Equal(t, time.Minute, s.interval)
+	s.close()
+
+	// invalid configurations
+	_, err = openSpool("", "1024", "")
+	assert.EqualError(t, err, "spoolmaxsize and spoolreplayinterval require spooldir")
+	_, err = openSpool(dir, "a", "")
+	assert.EqualError(t, err, "spoolmaxsize must be a integer: strconv.ParseInt: parsing \"a\": invalid syntax")
+	_, err = openSpool(dir, "0", "")
+	assert.EqualError(t, err, "spoolmaxsize must be greater than 0 but is:0")
+	_, err = openSpool(dir, "", "0")
+	assert.EqualError(t, err, "spoolreplayinterval must be greater than 0")
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = openSpool(filepath.Join(file, "spool"), "", "")
+	assert.ErrorContains(t, err, "spooldir can not be created: ")
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"SpoolDir": dir}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list spooldir:"+dir+" spoolmaxsize:104857600 spoolreplayinterval:5s", c.String())
+
+	// a second output instance must not share the spooldir
+	_, err = getRedisConfigFromEnv(mapEnvironment{"SpoolDir": dir}.get)
+	assert.ErrorContains(t, err, "is used by another output instance")
+	c.spool.close()
+}
+
+func TestSpoolFormat(t *testing.T) {
+	ts := time.Date(2026, time.October, 18, 10, 0, 0, 123, time.UTC)
+	values := []*logmessage{
+		{data: []byte(`{"@tag":"app","count":12345678901234,"log":"a"}`), tag: "app", timestamp: ts},
+		{data: []byte(`{"@tag":"","log":"b"}`), timestamp: ts.Add(time.Second)},
+	}
+	data := encodeSpool(values)
+	assert.Equal(t, "FBRSPOOL\x01\x03app", string(data[:13]))
+
+	file := filepath.Join(t.TempDir(), "1.spool")
+	require.NoError(t, os.WriteFile(file, data, 0600))
+	read, err := readSpool(file)
+	require.NoError(t, err)
+	require.Len(t, read, 2)
+	for i, v := range read {
+		assert.Equal(t, values[i].data, v.data)
+		assert.Equal(t, values[i].tag, v.tag)
+		assert.True(t, values[i].timestamp.Equal(v.timestamp))
+	}
+	assert.Equal(t, "12345678901234", fmt.Sprint(read[0].record["count"]), "numbers should be kept as they are")
+	assert.Equal(t, "a", read[0].record["log"])
+
+	require.NoError(t, os.WriteFile(file, data[:len(data)-3], 0600))
+	_, err = readSpool(file)
+	assert.EqualError(t, err, "spool file is truncated: unexpected EOF")
+
+	require.NoError(t, os.WriteFile(file, []byte("something else"), 0600))
+	_, err = readSpool(file)
+	assert.EqualError(t, err, "not a spool file")
+
+	require.NoError(t, os.WriteFile(file, []byte("FBRSPOOL\x02"), 0600))
+	_, err = readSpool(file)
+	assert.EqualError(t, err, "unknown spool version 2")
+}
+
+func TestSpoolAdd(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, "", "")
+	require.NoError(t, err)
+	assert.False(t, s.pending())
+
+	require.NoError(t, s.add([]*logmessage{{data: []byte("1")}}))
+	require.NoError(t, s.add([]*logmessage{{data: []byte("2")}}))
+	assert.True(t, s.pending())
+	assert.FileExists(t, filepath.Join(dir, "00000000000000000000.spool"))
+	assert.FileExists(t, filepath.Join(dir, "00000000000000000001.spool"))
+
+	// a restarted plugin continues with the files of the previous run
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000002.spool.tmp"), []byte("FBR"), 0600))
+	s.close()
+	s, err = openSpool(dir, "60", "")
+	require.NoError(t, err)
+	assert.Equal(t, []spoolFile{{seq: 0, size: 22}, {seq: 1, size: 22}}, s.files)
+	assert.Equal(t, int64(44), s.size)
+	assert.NoFileExists(t, filepath.Join(dir, "00000000000000000002.spool.tmp"), "partial files should be removed")
+
+	err = s.add([]*logmessage{{data: []byte("3")}})
+	assert.True(t, errors.Is(err, errSpoolFull))
+	assert.EqualError(t, err, "spool is full, 44 of 60 bytes are used")
+}
+
+func TestSpoolReplay(t *testing.T) {
+	s, err := openSpool(t.TempDir(), "", "")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.add([]*logmessage{{data: []byte(fmt.Sprintf(`{"n":%d}`, i))}}))
+	}
+
+	var replayed []string
+	fail := fmt.Errorf("dial tcp: connection refused")
+	send := func(values []*logmessage) error {
+		if fail != nil {
+			return fail
+		}
+		replayed = append(replayed, string(values[0].data))
+		return nil
+	}
+	s.replay(send)
+	assert.Empty(t, replayed)
+	assert.Len(t, s.files, 3, "nothing should be removed while the hosts are down")
+
+	fail = nil
+	s.replay(send)
+	assert.Equal(t, []string{`{"n":0}`, `{"n":1}`, `{"n":2}`}, replayed, "the flushes should be replayed in order")
+	assert.False(t, s.pending())
+	assert.Equal(t, int64(0), s.size)
+
+	// records rejected by redis are dropped
+	require.NoError(t, s.add([]*logmessage{{data: []byte(`{}`)}}))
+	fail = &sendError{record: 0, permanent: true, err: fmt.Errorf("WRONGTYPE")}
+	s.replay(send)
+	assert.False(t, s.pending())
+}
+
+func TestRedisDeliverSpool(t *testing.T) {
+	host := &fakeHost{}
+	s, err := openSpool(t.TempDir(), "", "")
+	require.NoError(t, err)
+	rc := &redisClient{
+		key:   mustKeyTemplate(t, "logs"),
+		pools: newTestPools(&healthConfig{failures: 3}, host),
+		spool: s,
+	}
+
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":1}`)}})
+	require.NoError(t, err, "the flush should be spooled while the host is down")
+	assert.True(t, s.pending())
+
+	host.up = true
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":2}`)}})
+	require.NoError(t, err)
+	assert.Equal(t, 0, host.sends, "a flush must not overtake the spool")
+	assert.Len(t, s.files, 2)
+
+	s.replay(rc.send)
+	assert.Equal(t, 2, host.sends)
+	assert.False(t, s.pending())
+
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":3}`)}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, host.sends, "an empty spool is bypassed")
+
+	// permanent errors are not spooled
+	host.reply = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":4}`)}})
+	assert.True(t, isPermanent(err))
+	assert.False(t, s.pending())
+
+	// the host is reachable, retryable errors are returned to fluent-bit
+	host.reply = redis.Error("OOM command not allowed when used memory > 'maxmemory'")
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":5}`)}})
+	assert.True(t, hasReply(err, "OOM"), "%v", err)
+	assert.False(t, s.pending(), "an error replied by redis must not be spooled")
+
+	host.reply = nil
+	host.length = 10
+	rc.backpressure = newBackpressure(&watermarks{high: 5, low: 1}, "")
+	err = rc.deliver([]*logmessage{{data: []byte(`{"n":6}`)}})
+	assert.ErrorIs(t, err, errBackpressure)
+	assert.False(t, s.pending(), "backpressure must not be spooled")
+}
+
+func TestUnavailable(t *testing.T) {
+	assert.False(t, unavailable(nil))
+	assert.False(t, unavailable(errors.New("pool is empty")))
+	assert.True(t, unavailable(withHost(errors.New("dial tcp: connection refused"), "a:6379")))
+	assert.False(t, unavailable(withHost(redis.Error("LOADING Redis is loading the dataset in memory"), "a:6379")))
+	assert.False(t, unavailable(&sendError{record: -1, err: fmt.Errorf("%w: key logs", errBackpressure)}))
+	assert.False(t, unavailable(withHost(fmt.Errorf("1 of 1 logs were not received: %w", errNoSubscribers), "a:6379")))
+	assert.False(t, unavailable(&sendError{record: 0, permanent: true, err: errors.New("invalid record")}))
+}
+
+func TestSpoolStart(t *testing.T) {
+	s, err := openSpool(t.TempDir(), "", "10ms")
+	require.NoError(t, err)
+	require.NoError(t, s.add([]*logmessage{{data: []byte(`{}`)}}))
+
+	replayed := make(chan int, 1)
+	s.start(func(values []*logmessage) error {
+		replayed <- len(values)
+		return nil
+	})
+	defer s.close()
+	select {
+	case n := <-replayed:
+		assert.Equal(t, 1, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the spool should be replayed in the background")
+	}
+	assert.Eventually(t, func() bool { return !s.pending() }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	streamFieldsMessage = "message"
+	streamFieldsRecord  = "record"
+)
+
+// A streamConfig holds the options used when records are written with XADD.
+type streamConfig struct {
+	// maxLen trims the stream to at most this many entries, 0 disables it.
+	maxLen int64
+	// minID evicts all entries with an id lower than minID, "" disables it.
+	minID string
+	// approx uses the "~" modifier, which lets redis trim in whole macro nodes.
+	approx bool
+	// fields is either streamFieldsMessage or streamFieldsRecord.
+	fields string
+}
+
+func (sc *streamConfig) String() string {
+	return fmt.Sprintf("maxlen:%d minid:%s approx:%t fields:%s", sc.maxLen, sc.minID, sc.approx, sc.fields)
+}
+
+func getStreamConfig(maxlen, minid, approx, fields string) (*streamConfig, error) {
+	sc := &streamConfig{}
+	// defaults
+	if approx == "" {
+		approx = "False"
+	}
+	if fields == "" {
+		fields = streamFieldsMessage
+	}
+
+	if maxlen != "" {
+		maxLen, err := strconv.ParseInt(maxlen, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("streammaxlen must be a integer: %w", err)
+		}
+		if maxLen < 0 {
+			return nil, fmt.Errorf("streammaxlen must not be negative:%d", maxLen)
+		}
+		sc.maxLen = maxLen
+	}
+	if sc.maxLen > 0 && minid != "" {
+		return nil, fmt.Errorf("streammaxlen and streamminid are mutually exclusive")
+	}
+	sc.minID = minid
+
+	a, err := strconv.ParseBool(approx)
+	if err != nil {
+		return nil, fmt.Errorf("streamtrimapprox must be a bool: %w", err)
+	}
+	sc.approx = a
+
+	fields = strings.ToLower(fields)
+	if fields != streamFieldsMessage && fields != streamFieldsRecord {
+		return nil, fmt.Errorf("streamfields must be one of %s or %s but is:%s", streamFieldsMessage, streamFieldsRecord, fields)
+	}
+	sc.fields = fields
+
+	return sc, nil
+}
+
+// xaddArgs returns the arguments of XADD which appends the message to the stream at key.
+func (sc *streamConfig) xaddArgs(key string, v *logmessage) []interface{} {
+	args := []interface{}{key}
+	if sc == nil {
+		return append(args, "*", streamFieldsMessage, v.data)
+	}
+
+	trim := "="
+	if sc.approx {
+		trim = "~"
+	}
+	switch {
+	case sc.maxLen > 0:
+		args = append(args, "MAXLEN", trim, sc.maxLen)
+	case sc.minID != "":
+		args = append(args, "MINID", trim, sc.minID)
+	}
+	args = append(args, "*")
+
+	if sc.fields != streamFieldsRecord || len(v.record) == 0 {
+		return append(args, streamFieldsMessage, v.data)
+	}
+
+	// sort the fields to get the same order in every entry
+	names := make([]string, 0, len(v.record))
+	for name := range v.record {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, name, fieldValue(v.record[name]))
+	}
+	return args
+}
+
+// fieldValue converts a record value into a stream field value, nested maps and
+// slices are stored as json.
+func fieldValue(value interface{}) interface{} {
+	switch t := value.(type) {
+	case string:
+		return t
+	case []byte:
+		return t
+	}
+	js, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return js
+}
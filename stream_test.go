@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetStreamConfig(t *testing.T) {
+	// test for defaults
+	sc, err := getStreamConfig("", "", "", "")
+	if err != nil {
+		assert.Fail(t, "configuration failed with:%v", err)
+	}
+	assert.Equal(t, int64(0), sc.maxLen, "maxlen expected to be 0 by default")
+	assert.Equal(t, "", sc.minID, "minid expected to be '' by default")
+	assert.Equal(t, false, sc.approx, "approx expected to be false by default")
+	assert.Equal(t, "message", sc.fields, "fields expected to be 'message' by default")
+	assert.Equal(t, "maxlen:0 minid: approx:false fields:message", sc.String())
+
+	sc, err = getStreamConfig("1000", "", "true", "Record")
+	if err != nil {
+		assert.Fail(t, "configuration failed with:%v", err)
+	}
+	assert.Equal(t, int64(1000), sc.maxLen, "maxlen expected to be 1000")
+	assert.Equal(t, true, sc.approx, "approx expected to be true")
+	assert.Equal(t, "record", sc.fields, "fields expected to be 'record'")
+
+	// invalid configurations
+	_, err = getStreamConfig("A", "", "", "")
+	assert.EqualError(t, err, "streammaxlen must be a integer: strconv.ParseInt: parsing \"A\": invalid syntax")
+
+	_, err = getStreamConfig("-1", "", "", "")
+	assert.EqualError(t, err, "streammaxlen must not be negative:-1")
+
+	_, err = getStreamConfig("10", "1526985054069-0", "", "")
+	assert.EqualError(t, err, "streammaxlen and streamminid are mutually exclusive")
+
+	_, err = getStreamConfig("", "", "xxx", "")
+	assert.EqualError(t, err, "streamtrimapprox must be a bool: strconv.ParseBool: parsing \"xxx\": invalid syntax")
+
+	_, err = getStreamConfig("", "", "", "fields")
+	assert.EqualError(t, err, "streamfields must be one of message or record but is:fields")
+}
+
+func TestGetRedisConfigFromEnvDataType(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{}.get)
+	assert.NoError(t, err)
+	assert.Equal(t, "list", c.dataType, "datatype expected to be 'list' by default")
+	assert.Nil(t, c.stream, "stream config expected only for datatype stream")
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "Stream", "StreamMinID": "0-1"}.get)
+	assert.NoError(t, err)
+	assert.Equal(t, "stream", c.dataType, "datatype expected to be 'stream'")
+	assert.Equal(t, "0-1", c.stream.minID, "minid expected to be '0-1'")
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:stream stream:{maxlen:0 minid:0-1 approx:false fields:message}", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "hash"}.get)
+	assert.EqualError(t, err, "datatype must be one of list, stream or channel but is:hash")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Key": "${x"}.get)
+	assert.Error(t, err, "key must be validated")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"DataType": "stream", "StreamMaxLen": "x"}.get)
+	assert.Error(t, err, "stream options must be validated")
+}
+
+func TestXaddArgs(t *testing.T) {
+	v := &logmessage{
+		data: []byte(`{"a":"b"}`),
+		record: map[string]interface{}{
+			"log":    "a line",
+			"five":   5,
+			"nested": map[string]interface{}{"key": "value"},
+		},
+	}
+
+	sc := &streamConfig{fields: streamFieldsMessage}
+	assert.Equal(t, []interface{}{"stream", "*", "message", v.data}, sc.xaddArgs("stream", v))
+
+	sc = &streamConfig{maxLen: 100, fields: streamFieldsMessage}
+	assert.Equal(t, []interface{}{"stream", "MAXLEN", "=", int64(100), "*", "message", v.data}, sc.xaddArgs("stream", v))
+
+	sc = &streamConfig{minID: "1526985054069-0", approx: true, fields: streamFieldsMessage}
+	assert.Equal(t, []interface{}{"stream", "MINID", "~", "1526985054069-0", "*", "message", v.data}, sc.xaddArgs("stream", v))
+
+	sc = &streamConfig{fields: streamFieldsRecord}
+	assert.Equal(t, []interface{}{"stream", "*",
+		"five", []byte("5"),
+		"log", "a line",
+		"nested", []byte(`{"key":"value"}`),
+	}, sc.xaddArgs("stream", v))
+
+	// without a record the json message is used
+	assert.Equal(t, []interface{}{"stream", "*", "message", v.data}, sc.xaddArgs("stream", &logmessage{data: v.data}))
+}
+
+// A recordingConnection records all commands, the replies are taken from
+// replies, or int64(1) if no reply is left.
+type recordingConnection struct {
+	commands [][]interface{}
+	flushed  bool
+	replies  []interface{}
+}
+
+func (r *recordingConnection) Send(cmd string, args ...interface{}) error {
+	r.commands = append(r.commands, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (r *recordingConnection) Flush() error {
+	r.flushed = true
+	return nil
+}
+
+func (r *recordingConnection) Receive() (interface{}, error) {
+	if len(r.replies) == 0 {
+		return int64(1), nil
+	}
+	reply := r.replies[0]
+	r.replies = r.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func TestRedisSendStream(t *testing.T) {
+	rc := &redisClient{
+		key:      mustKeyTemplate(t, "logs"),
+		dataType: dataTypeStream,
+		stream:   &streamConfig{maxLen: 10, approx: true, fields: streamFieldsMessage},
+	}
+	values := []*logmessage{
+		{data: []byte("test1")},
+		{data: []byte("test2")},
+	}
+	conn := &recordingConnection{}
+	err := rc.sendImpl(conn, "", values)
+	assert.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"XADD", "logs", "MAXLEN", "~", int64(10), "*", "message", []byte("test1")},
+		{"XADD", "logs", "MAXLEN", "~", int64(10), "*", "message", []byte("test2")},
+	}, conn.commands)
+	assert.True(t, conn.flushed, "data should be flushed")
+}
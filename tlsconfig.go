@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps the values of TLSMinVersion to tls versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions hold the tls settings of all hosts. The certificates are read
+// again before a connection is dialed if the files changed.
+type tlsOptions struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	minVersion uint16
+	// pins are sha256 hashes of the SubjectPublicKeyInfo, one of them must be in the chain of the server
+	pins [][]byte
+	// explicit is true if any option is configured
+	explicit bool
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+}
+
+func getTLSOptions(caFile, certFile, keyFile, serverName, minVersion, pins string) (*tlsOptions, error) {
+	o := &tlsOptions{
+		caFile:     caFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		serverName: serverName,
+		explicit:   caFile != "" || certFile != "" || keyFile != "" || serverName != "" || minVersion != "" || pins != "",
+	}
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	var ok bool
+	o.minVersion, ok = tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("tlsminversion must be one of 1.0, 1.1, 1.2 or 1.3 but is:%s", minVersion)
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("tlscertfile and tlskeyfile must be used together")
+	}
+	for _, pin := range strings.Fields(pins) {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("tlspinsha256 must contain base64 encoded sha256 hashes but contains:%s", pin)
+		}
+		o.pins = append(o.pins, hash)
+	}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// String returns the configured options, prefixed with a space.
+func (o *tlsOptions) String() string {
+	var sb strings.Builder
+	if o.caFile != "" {
+		fmt.Fprintf(&sb, " tlscafile:%s", o.caFile)
+	}
+	if o.certFile != "" {
+		fmt.Fprintf(&sb, " tlscertfile:%s tlskeyfile:%s", o.certFile, o.keyFile)
+	}
+	if o.serverName != "" {
+		fmt.Fprintf(&sb, " tlsservername:%s", o.serverName)
+	}
+	for name, version := range tlsVersions {
+		if version == o.minVersion && version != tls.VersionTLS12 {
+			fmt.Fprintf(&sb, " tlsminversion:%s", name)
+		}
+	}
+	if len(o.pins) > 0 {
+		fmt.Fprintf(&sb, " tlspins:%d", len(o.pins))
+	}
+	return sb.String()
+}
+
+// configured returns true if any tls option is set. Whoever configures tls
+// expects the server to be verified, e.g. against TLSServerName, so skipping
+// the verification by default makes no sense then.
+func (o *tlsOptions) configured() bool {
+	return o != nil && o.explicit
+}
+
+// reload reads all files which changed since they were read.
+func (o *tlsOptions) reload() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.modTimes == nil {
+		o.modTimes = make(map[string]time.Time)
+	}
+	changed := make(map[string]time.Time)
+	for _, file := range []string{o.caFile, o.certFile, o.keyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("unable to read tls file: %w", err)
+		}
+		if !info.ModTime().Equal(o.modTimes[file]) {
+			changed[file] = info.ModTime()
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	roots, cert := o.roots, o.cert
+	if _, ok := changed[o.caFile]; ok {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return fmt.Errorf("unable to read tlscafile: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tlscafile %s contains no certificate", o.caFile)
+		}
+	}
+	_, certChanged := changed[o.certFile]
+	_, keyChanged := changed[o.keyFile]
+	if certChanged || keyChanged {
+		c, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load tlscertfile and tlskeyfile: %w", err)
+		}
+		cert = &c
+	}
+	// the files are only marked as read if all of them are valid
+	o.roots, o.cert = roots, cert
+	for file, modTime := range changed {
+		o.modTimes[file] = modTime
+	}
+	return nil
+}
+
+// config returns the tls configuration to dial a host, the options may be nil.
+func (o *tlsOptions) config(skipVerify bool) *tls.Config {
+	cfg := &tls.Config{InsecureSkipVerify: skipVerify, MinVersion: tls.VersionTLS12} // nolint:gosec
+	if o == nil {
+		return cfg
+	}
+	if err := o.reload(); err != nil {
+		// the previous certificates are used until the files are valid again
+		fmt.Printf("[out-redis] %v\n", err)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	cfg.MinVersion = o.minVersion
+	cfg.ServerName = o.serverName
+	cfg.RootCAs = o.roots
+	if o.cert != nil {
+		cfg.Certificates = []tls.Certificate{*o.cert}
+	}
+	if len(o.pins) > 0 {
+		cfg.VerifyConnection = o.verifyPins
+	}
+	return cfg
+}
+
+// verifyPins checks if a certificate of the server matches one of the pins,
+// it is called even if the verification of the chain is skipped. Only the
+// certificates of a verified chain count, the server may send any other
+// certificate along. Without verification only the leaf counts, its key is
+// the one the handshake was signed with.
+func (o *tlsOptions) verifyPins(cs tls.ConnectionState) error {
+	chains := cs.VerifiedChains
+	if len(chains) == 0 && len(cs.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{cs.PeerCertificates[:1]}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range o.pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches a pinned public key", cs.ServerName)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for 127.0.0.1 and its key in pem format.
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "redis"},
+		DNSNames:     []string{"redis.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes the file with a new modification time.
+func writeFile(t *testing.T, file string, data []byte, modTime time.Time) {
+	require.NoError(t, os.WriteFile(file, data, 0600))
+	require.NoError(t, os.Chtimes(file, modTime, modTime))
+}
+
+// serveTLS starts a fake redis with a certificate of ca, clients must present
+// a certificate of clientCA if it is set.
+func serveTLS(t *testing.T, ca, clientCA *testCA) (*fakeRedisServer, redisHost, *tls.Certificate) {
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AddCert(clientCA.cert)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	server := serveFakeRedis(t, l)
+	return server, redisHost{hostname: "127.0.0.1", port: l.Addr().(*net.TCPAddr).Port, usetls: true}, &cert
+}
+
+func TestGetTLSOptions(t *testing.T) {
+	o, err := getTLSOptions("", "", "", "", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), o.minVersion)
+	assert.False(t, o.configured())
+	assert.Equal(t, "", o.String())
+
+	_, err = getTLSOptions("", "", "", "", "1.4", "")
+	assert.EqualError(t, err, "tlsminversion must be one of 1.0, 1.1, 1.2 or 1.3 but is:1.4")
+	_, err = getTLSOptions("", "client.pem", "", "", "", "")
+	assert.EqualError(t, err, "tlscertfile and tlskeyfile must be used together")
+	_, err = getTLSOptions("", "", "", "", "", "abc")
+	assert.EqualError(t, err, "tlspinsha256 must contain base64 encoded sha256 hashes but contains:abc")
+	_, err = getTLSOptions(filepath.Join(t.TempDir(), "ca.pem"), "", "", "", "", "")
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, []byte("no pem"), time.Now())
+	_, err = getTLSOptions(caFile, "", "", "", "", "")
+	assert.EqualError(t, err, "tlscafile "+caFile+" contains no certificate")
+}
+
+func TestGetRedisConfigFromEnvTLS(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, newTestCA(t).pem, time.Now())
+
+	c, err := getRedisConfigFromEnv(mapEnvironment{"UseTLS": "true", "TLSCAFile": caFile, "TLSServerName": "redis.example.com", "TLSMinVersion": "1.3"}.get)
+	require.NoError(t, err)
+	assert.False(t, c.tlsskipverify, "the server should be verified if a ca is configured")
+	assert.False(t, c.hosts[0].tlsskipverify)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:true tlsskipverify:false key:logstash datatype:list tlscafile:"+caFile+" tlsservername:redis.example.com tlsminversion:1.3", c.String())
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"UseTLS": "true", "TLSCAFile": caFile, "TLSSkipVerify": "true"}.get)
+	require.NoError(t, err)
+	assert.True(t, c.tlsskipverify, "an explicit tlsskipverify should be kept")
+
+	for option, value := range map[string]string{"TLSServerName": "redis.example.com", "TLSMinVersion": "1.2"} {
+		c, err = getRedisConfigFromEnv(mapEnvironment{"UseTLS": "true", option: value}.get)
+		require.NoError(t, err)
+		assert.False(t, c.tlsskipverify, "the server should be verified if %s is configured", option)
+	}
+
+	c, err = getRedisConfigFromEnv(mapEnvironment{"UseTLS": "true"}.get)
+	require.NoError(t, err)
+	assert.True(t, c.tlsskipverify, "without tls options the verification is skipped for compatibility")
+}
+
+func TestTLSVerify(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, ca.pem, time.Now().Add(-time.Minute))
+
+	server, host, _ := serveTLS(t, ca, nil)
+	host.tls, _ = getTLSOptions(caFile, "", "", "", "", "")
+	pool := newHostPool(host)
+	require.NoError(t, ping(pool), "the server should be verified with the ca")
+	pool.Close()
+	assert.Len(t, server.received(), 1)
+
+	// the name must match the certificate
+	host.tls.serverName = "other.example.com"
+	pool = newHostPool(host)
+	assert.Error(t, ping(pool), "the server name should be verified")
+	pool.Close()
+	host.tls.serverName = "redis.example.com"
+
+	// the ca is reloaded if the file changes
+	other := newTestCA(t)
+	_, otherHost, _ := serveTLS(t, other, nil)
+	otherHost.tls = host.tls
+	pool = newHostPool(otherHost)
+	assert.Error(t, ping(pool), "a server of an unknown ca should be rejected")
+	writeFile(t, caFile, other.pem, time.Now())
+	assert.NoError(t, ping(pool), "the new ca should be used")
+	pool.Close()
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca, clientCA := newTestCA(t), newTestCA(t)
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writeFile(t, caFile, ca.pem, time.Now())
+	certPEM, keyPEM := clientCA.issue(t, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, certPEM, time.Now().Add(-time.Minute))
+	writeFile(t, keyFile, keyPEM, time.Now().Add(-time.Minute))
+
+	_, host, _ := serveTLS(t, ca, clientCA)
+	pool := newHostPool(host)
+	assert.Error(t, ping(pool), "the server should require a client certificate")
+	pool.Close()
+
+	var err error
+	host.tls, err = getTLSOptions(caFile, certFile, keyFile, "", "", "")
+	require.NoError(t, err)
+	pool = newHostPool(host)
+	assert.NoError(t, ping(pool))
+	pool.Close()
+
+	// a new certificate is loaded if the files change
+	certPEM, keyPEM = newTestCA(t).issue(t, x509.ExtKeyUsageClientAuth)
+	writeFile(t, certFile, certPEM, time.Now())
+	writeFile(t, keyFile, keyPEM, time.Now())
+	pool = newHostPool(host)
+	assert.Error(t, ping(pool), "the new certificate should be presented")
+	pool.Close()
+}
+
+func TestTLSPinning(t *testing.T) {
+	_, host, cert := serveTLS(t, newTestCA(t), nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("other key"))
+
+	// the pins are checked even if the chain is not verified
+	host.tlsskipverify = true
+	host.tls, err = getTLSOptions("", "", "", "", "", base64.StdEncoding.EncodeToString(other[:])+" "+base64.StdEncoding.EncodeToString(hash[:]))
+	require.NoError(t, err)
+	pool := newHostPool(host)
+	assert.NoError(t, ping(pool), "one of the pins should match")
+	pool.Close()
+
+	host.tls, err = getTLSOptions("", "", "", "", "", base64.StdEncoding.EncodeToString(other[:]))
+	require.NoError(t, err)
+	pool = newHostPool(host)
+	err = ping(pool)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "matches a pinned public key")
+	pool.Close()
+}
+
+func TestTLSPinningAppendedCertificate(t *testing.T) {
+	_, host, cert := serveTLS(t, newTestCA(t), nil)
+	pinned, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	hash := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+
+	// another server sends the public certificate of the pinned one after its own
+	certPEM, keyPEM := newTestCA(t).issue(t, x509.ExtKeyUsageServerAuth)
+	attacker, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	attacker.Certificate = append(attacker.Certificate, cert.Certificate[0])
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{attacker}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	serveFakeRedis(t, l)
+	host.port = l.Addr().(*net.TCPAddr).Port
+	host.tlsskipverify = true
+	host.tls, err = getTLSOptions("", "", "", "", "", base64.StdEncoding.EncodeToString(hash[:]))
+	require.NoError(t, err)
+	pool := newHostPool(host)
+	err = ping(pool)
+	require.Error(t, err, "only the leaf counts if the chain is not verified")
+	assert.Contains(t, err.Error(), "matches a pinned public key")
+	pool.Close()
+}
+
+func TestVerifyPins(t *testing.T) {
+	parse := func(ca *testCA) *x509.Certificate {
+		certPEM, _ := ca.issue(t, x509.ExtKeyUsageServerAuth)
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		return cert
+	}
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	leaf, other := parse(ca), parse(otherCA)
+	pin := func(cert *x509.Certificate) *tlsOptions {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return &tlsOptions{pins: [][]byte{hash[:]}}
+	}
+
+	// the chain is not verified
+	assert.NoError(t, pin(leaf).verifyPins(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca.cert}}))
+	assert.Error(t, pin(ca.cert).verifyPins(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca.cert}}), "only the leaf is known to belong to the server")
+	assert.Error(t, pin(leaf).verifyPins(tls.ConnectionState{PeerCertificates: []*x509.Certificate{other, leaf}}))
+
+	// the chain is verified
+	assert.NoError(t, pin(ca.cert).verifyPins(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}, VerifiedChains: [][]*x509.Certificate{{leaf, ca.cert}}}))
+	assert.Error(t, pin(leaf).verifyPins(tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{other, leaf},
+		VerifiedChains:   [][]*x509.Certificate{{other, otherCA.cert}},
+	}), "a certificate outside of the verified chain does not count")
+}
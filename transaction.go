@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// write sends the commands in a pipeline, wrapped in a transaction if configured.
+func (r *redisClient) write(rd asyncConnection, cmds []*command) error {
+	if r.transactional {
+		if r.script != nil {
+			// a NOSCRIPT within EXEC would not roll back the other commands
+			if err := r.script.load(rd); err != nil {
+				return &sendError{record: -1, permanent: isPermanentReply(err), err: denied(fmt.Errorf("error loading the script: %w", err))}
+			}
+		}
+		return transaction(rd, cmds)
+	}
+	if r.script != nil {
+		return r.script.pipeline(rd, cmds)
+	}
+	return pipeline(rd, cmds)
+}
+
+// transaction sends all commands in a MULTI/EXEC block. MULTI is confirmed
+// before the commands are sent: if it is rejected, e.g. with NOPERM by the
+// acl, redis would execute the commands one by one. If a command is rejected
+// while it is queued, redis aborts the transaction with EXECABORT and none of
+// the commands are executed, the error of the rejected command is returned
+// then. Errors of commands which are executed, e.g. WRONGTYPE, do not roll
+// back the others.
+func transaction(rd asyncConnection, cmds []*command) error {
+	err := rd.Send("MULTI")
+	if err == nil {
+		err = rd.Flush()
+	}
+	if err == nil {
+		_, err = rd.Receive()
+	}
+	if err != nil {
+		return &sendError{record: -1, permanent: isPermanentReply(err), err: denied(fmt.Errorf("error starting the transaction, no record is written: %w", err))}
+	}
+
+	for _, c := range cmds {
+		if err := rd.Send(c.name, c.args...); err != nil {
+			return c.connError(err)
+		}
+	}
+	if err := rd.Send("EXEC"); err != nil {
+		return &sendError{record: -1, err: fmt.Errorf("error executing the transaction: %w", err)}
+	}
+	if err := rd.Flush(); err != nil {
+		return &sendError{record: -1, err: err}
+	}
+
+	// the commands are queued and replied with QUEUED, or rejected
+	var queueErr *sendError
+	permanent := true
+	for _, c := range cmds {
+		_, err := rd.Receive()
+		if err == nil {
+			continue
+		}
+		if !isReply(err) {
+			return &sendError{record: c.index, err: c.error(err)}
+		}
+		se := c.fail(err)
+		permanent = permanent && se.permanent
+		if queueErr == nil {
+			queueErr = se
+		}
+	}
+
+	reply, err := rd.Receive()
+	if err != nil {
+		if !isReply(err) {
+			// it is unknown whether the transaction was executed
+			return &sendError{record: -1, err: fmt.Errorf("error executing the transaction: %w", err)}
+		}
+		if hasReply(err, "EXECABORT") && queueErr != nil {
+			queueErr.permanent = permanent
+			queueErr.err = fmt.Errorf("transaction is aborted, no record is written: %w", queueErr.err)
+			return queueErr
+		}
+		return &sendError{record: -1, permanent: isPermanentReply(err), err: denied(fmt.Errorf("error executing the transaction: %w", err))}
+	}
+	replies, err := redis.Values(reply, nil)
+	if err != nil {
+		return &sendError{record: -1, err: fmt.Errorf("transaction is discarded: %w", err)}
+	}
+	if len(replies) != len(cmds) {
+		return &sendError{record: -1, err: fmt.Errorf("transaction replied %d results for %d commands", len(replies), len(cmds))}
+	}
+
+	// the commands were executed, check the result of each of them
+	var firstErr *sendError
+	permanent = true
+	for i, c := range cmds {
+		if rerr, ok := replies[i].(redis.Error); ok {
+			se := c.fail(rerr)
+			permanent = permanent && se.permanent
+			if firstErr == nil {
+				firstErr = se
+			}
+			continue
+		}
+		c.reply(replies[i])
+	}
+	if firstErr == nil {
+		return nil
+	}
+	firstErr.permanent = permanent
+	return firstErr
+}
+
+// isReply returns true if err is an error replied by redis, other errors
+// break the connection.
+func isReply(err error) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr)
+}
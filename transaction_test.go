@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRedisConfigTransactional(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Transactional": "true"}.get)
+	require.NoError(t, err)
+	assert.True(t, c.transactional)
+	assert.Equal(t, "hosts:[{127.0.0.1 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list transactional:true", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Transactional": "yes"}.get)
+	assert.EqualError(t, err, "transactional must be a bool: strconv.ParseBool: parsing \"yes\": invalid syntax")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Transactional": "true", "Cluster": "true"}.get)
+	assert.EqualError(t, err, "transactional can not be used in cluster mode")
+}
+
+func TestRedisSendTransaction(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), transactional: true}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+
+	conn := &recordingConnection{replies: []interface{}{"OK", "QUEUED", "QUEUED", []interface{}{int64(1), int64(2)}}}
+	err := rc.sendImpl(conn, "", values)
+	require.NoError(t, err, "send should be ok")
+	assert.Equal(t, [][]interface{}{
+		{"MULTI"},
+		{"RPUSH", "logstash", []byte("test1")},
+		{"RPUSH", "logstash", []byte("test2")},
+		{"EXEC"},
+	}, conn.commands)
+	assert.True(t, conn.flushed)
+}
+
+func TestRedisSendTransactionAborted(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), transactional: true}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+	execAbort := redis.Error("EXECABORT Transaction discarded because of previous errors.")
+
+	// a retryable error while queueing aborts the transaction, the flush is retried
+	conn := &recordingConnection{replies: []interface{}{"OK", "QUEUED", redis.Error("OOM command not allowed when used memory > 'maxmemory'."), execAbort}}
+	err := rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 1: transaction is aborted, no record is written: error setting key logstash to test2: OOM command not allowed when used memory > 'maxmemory'.")
+	assert.False(t, isPermanent(err))
+
+	// a permanent error while queueing is not retried
+	conn = &recordingConnection{replies: []interface{}{"OK", redis.Error("NOPERM this user has no permissions to access the 'logstash' key"), "QUEUED", execAbort}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 0: transaction is aborted, no record is written: permission denied by the acl of the redis user: error setting key logstash to test1: NOPERM this user has no permissions to access the 'logstash' key")
+	assert.True(t, isPermanent(err))
+
+	// EXECABORT without a rejected command
+	conn = &recordingConnection{replies: []interface{}{"OK", "QUEUED", "QUEUED", execAbort}}
+	err = rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "error executing the transaction: EXECABORT Transaction discarded because of previous errors.")
+	assert.True(t, isPermanent(err))
+}
+
+func TestRedisSendTransactionMultiRejected(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), transactional: true}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+
+	// without MULTI redis would execute every command on its own
+	conn := &recordingConnection{replies: []interface{}{redis.Error("NOPERM this user has no permissions to run the 'multi' command")}}
+	err := rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "permission denied by the acl of the redis user: error starting the transaction, no record is written: NOPERM this user has no permissions to run the 'multi' command")
+	assert.True(t, isPermanent(err))
+	assert.Equal(t, [][]interface{}{{"MULTI"}}, conn.commands, "no command should be sent")
+}
+
+func TestRedisSendTransactionExecError(t *testing.T) {
+	rc := &redisClient{key: mustKeyTemplate(t, "logstash"), transactional: true}
+	values := []*logmessage{{data: []byte("test1")}, {data: []byte("test2")}}
+
+	// errors of executed commands are not rolled back
+	wrongType := redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	conn := &recordingConnection{replies: []interface{}{"OK", "QUEUED", "QUEUED", []interface{}{int64(1), wrongType}}}
+	err := rc.sendImpl(conn, "", values)
+	assert.EqualError(t, err, "record 1: error setting key logstash to test2: WRONGTYPE Operation against a key holding the wrong kind of value")
+	assert.True(t, isPermanent(err))
+
+	// a discarded transaction is replied with nil
+	conn = &recordingConnection{replies: []interface{}{"OK", "QUEUED", "QUEUED", nil}}
+	err = rc.sendImpl(conn, "", values)
+	assert.Error(t, err)
+	assert.False(t, isPermanent(err))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Possible write modes, how many hosts must acknowledge a flush.
+const (
+	writeModeAny    = "any"
+	writeModeAll    = "all"
+	writeModeQuorum = "quorum"
+)
+
+// A writeMode defines to how many hosts a flush is written.
+type writeMode struct {
+	mode string
+	// quorum is the number of hosts which must acknowledge a flush in quorum mode.
+	quorum int
+}
+
+func getWriteMode(mode string) (*writeMode, error) {
+	if mode == "" {
+		return &writeMode{mode: writeModeAny}, nil
+	}
+	mode = strings.ToLower(mode)
+	switch mode {
+	case writeModeAny, writeModeAll:
+		return &writeMode{mode: mode}, nil
+	}
+	if !strings.HasPrefix(mode, writeModeQuorum+"=") {
+		return nil, fmt.Errorf("writemode must be one of %s, %s or %s=N but is:%s", writeModeAny, writeModeAll, writeModeQuorum, mode)
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(mode, writeModeQuorum+"="))
+	if err != nil {
+		return nil, fmt.Errorf("writemode quorum must be a integer: %w", err)
+	}
+	if n < 1 {
+		return nil, fmt.Errorf("writemode quorum must be at least 1 but is:%d", n)
+	}
+	return &writeMode{mode: writeModeQuorum, quorum: n}, nil
+}
+
+func (w *writeMode) String() string {
+	if w.mode == writeModeQuorum {
+		return fmt.Sprintf("%s=%d", w.mode, w.quorum)
+	}
+	return w.mode
+}
+
+// replicated returns true if a flush is written to more than one host.
+func (w *writeMode) replicated() bool {
+	return w != nil && w.mode != writeModeAny
+}
+
+// required returns the number of hosts which must acknowledge a flush.
+func (w *writeMode) required(hosts int) int {
+	switch w.mode {
+	case writeModeAll:
+		return hosts
+	case writeModeQuorum:
+		return w.quorum
+	}
+	return 1
+}
+
+// targets returns the indexes of the healthy pools, or of all pools if fewer
+// than required are healthy.
+func (rp *redisPools) targets(required int) []int {
+	healthy := rp.candidates()
+	if len(healthy) >= required {
+		return healthy
+	}
+	var all []int
+	for i, pool := range rp.pools {
+		if pool != nil {
+			all = append(all, i)
+		}
+	}
+	return all
+}
+
+// sendReplicated writes the flush to several hosts in parallel, it returns as
+// soon as the required number of hosts acknowledged the flush. Writes to the
+// remaining hosts are completed in the background.
+func (r *redisClient) sendReplicated(values []*logmessage) error {
+	required := r.writeMode.required(len(r.pools.pools))
+	targets := r.pools.targets(required)
+	if len(targets) < required {
+		return fmt.Errorf("writemode %s requires %d hosts but only %d are available", r.writeMode, required, len(targets))
+	}
+
+	// the commands are created once, so every host gets the same keys
+	batches := r.key.groupByKey(values)
+	cmds := r.commands(batches)
+
+	results := make(chan error, len(targets))
+	for _, i := range targets {
+		r.writes.Add(1)
+		go func(i int) {
+			defer r.writes.Done()
+			results <- r.pipelineTo(i, batches, cmds)
+		}(i)
+	}
+
+	var (
+		acks int
+		errs []error
+	)
+	for range targets {
+		err := <-results
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			errs = append(errs, err)
+			if len(targets)-len(errs) < required {
+				// the required acknowledges can not be reached anymore
+				break
+			}
+			continue
+		}
+		acks++
+		if acks == required {
+			break
+		}
+	}
+	if acks < required {
+		// retry if any host may succeed later
+		err := errs[0]
+		for _, e := range errs {
+			if !isPermanent(e) {
+				err = e
+				break
+			}
+		}
+		return fmt.Errorf("%d hosts acknowledged the flush but writemode %s requires %d: %w", acks, r.writeMode, required, err)
+	}
+
+	r.report(cmds)
+	if r.dataType == dataTypeChannel {
+		return r.reportPublished(batches)
+	}
+	return nil
+}
+
+// pipelineTo sends the commands to the pool at index i and tracks its health.
+func (r *redisClient) pipelineTo(i int, batches []*keyBatch, cmds []*command) error {
+	conn := r.pools.pools[i].Get()
+	defer conn.Close()
+	rd := &redisConn{conn}
+	host := r.pools.host(i)
+	err := r.checkBackpressure(rd, host, batches)
+	if err == nil {
+		err = r.write(rd, cmds)
+	}
+	err = withHost(err, host)
+	if err == nil {
+		r.pools.success(i)
+		return nil
+	}
+	if !isPermanent(err) && blamesHost(err) {
+		r.pools.failure(i, err)
+	}
+	return err
+}
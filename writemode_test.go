@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetWriteMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		want     *writeMode
+		required int
+		err      string
+	}{
+		{mode: "", want: &writeMode{mode: writeModeAny}, required: 1},
+		{mode: "ALL", want: &writeMode{mode: writeModeAll}, required: 3},
+		{mode: "quorum=2", want: &writeMode{mode: writeModeQuorum, quorum: 2}, required: 2},
+		{mode: "quorum=0", err: "writemode quorum must be at least 1 but is:0"},
+		{mode: "quorum=a", err: "writemode quorum must be a integer: strconv.Atoi: parsing \"a\": invalid syntax"},
+		{mode: "some", err: "writemode must be one of any, all or quorum=N but is:some"},
+	}
+	for _, tt := range tests {
+		w, err := getWriteMode(tt.mode)
+		if tt.err != "" {
+			assert.EqualError(t, err, tt.err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, w)
+		assert.Equal(t, tt.required, w.required(3))
+	}
+}
+
+func TestGetRedisConfigFromEnvWriteMode(t *testing.T) {
+	c, err := getRedisConfigFromEnv(mapEnvironment{"Hosts": "a b c", "WriteMode": "quorum=2"}.get)
+	require.NoError(t, err)
+	assert.Equal(t, "hosts:[{a 6379} {b 6379} {c 6379}] db:0 usetls:false tlsskipverify:true key:logstash datatype:list writemode:quorum=2", c.String())
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"Hosts": "a b", "WriteMode": "quorum=3"}.get)
+	assert.EqualError(t, err, "writemode quorum=3 requires 3 hosts but only 2 are configured")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"WriteMode": "all", "Cluster": "true"}.get)
+	assert.EqualError(t, err, "writemode all can not be used in cluster mode")
+
+	_, err = getRedisConfigFromEnv(mapEnvironment{"WriteMode": "all", "SentinelHosts": "a", "SentinelMaster": "mymaster"}.get)
+	assert.EqualError(t, err, "writemode all can not be used with sentinelhosts")
+}
+
+func newReplicatedClient(t *testing.T, mode string, hosts ...*fakeHost) *redisClient {
+	w, err := getWriteMode(mode)
+	require.NoError(t, err)
+	return &redisClient{
+		key:       mustKeyTemplate(t, "logs"),
+		expiry:    newKeyExpiry(time.Hour),
+		writeMode: w,
+		pools:     newTestPools(&healthConfig{failures: 1, backoff: time.Hour, maxBackoff: time.Hour, interval: time.Second}, hosts...),
+	}
+}
+
+func TestRedisSendAll(t *testing.T) {
+	hosts := []*fakeHost{{up: true}, {up: true}, {up: true}}
+	rc := newReplicatedClient(t, "all", hosts...)
+	values := []*logmessage{
+		{data: []byte("test1")},
+		{data: []byte("test2")},
+	}
+
+	require.NoError(t, rc.send(values))
+	rc.writes.Wait()
+	for _, h := range hosts {
+		assert.Equal(t, 3, h.sends, "every host should get both records and the expire")
+	}
+
+	// one host is down
+	hosts[1].up = false
+	err := rc.send(values)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "writemode all requires 3: host 10.0.0.2:6379: record 0: error setting key logs to test1: dial tcp 10.0.0.2:6379: connection refused")
+	assert.False(t, isPermanent(err), "the flush should be retried")
+	rc.writes.Wait()
+	assert.True(t, rc.pools.health[1].isEjected())
+
+	// ejected hosts are written to anyway
+	err = rc.send(values)
+	assert.Error(t, err)
+	rc.writes.Wait()
+}
+
+func TestRedisSendQuorum(t *testing.T) {
+	slow := &fakeHost{up: true, wait: make(chan struct{})}
+	hosts := []*fakeHost{{up: true}, {up: true}, slow}
+	rc := newReplicatedClient(t, "quorum=2", hosts...)
+	values := []*logmessage{{data: []byte("test1")}}
+
+	require.NoError(t, rc.send(values), "the flush should succeed without the slow host")
+	close(slow.wait)
+	rc.writes.Wait()
+	assert.Equal(t, 2, slow.sends, "the slow host should get the flush in the background")
+
+	// a quorum is not reached if two hosts fail
+	hosts[0].up = false
+	hosts[1].reply = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	err := rc.send(values)
+	assert.Error(t, err)
+	assert.False(t, isPermanent(err), "the flush should be retried if a host may succeed later")
+	rc.writes.Wait()
+
+	// all hosts rejected the flush
+	for _, h := range hosts {
+		h.up = true
+		h.reply = redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	err = rc.send(values)
+	assert.True(t, isPermanent(err), "the flush should not be retried if all hosts rejected it")
+	rc.writes.Wait()
+}